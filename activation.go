@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3).
+const listenFDsStart = 3
+
+// activationListener returns the listener passed by systemd socket activation
+// (see sd_listen_fds(3)) to the process with the given pid, or nil if there is
+// none. The environment is read via getenv, and the passed file descriptors
+// start at firstFD (listenFDsStart). Only the first socket is used.
+func activationListener(pid int, getenv func(string) string, firstFD uintptr) (net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil // not activated, or meant for another process
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		slog.Warn("systemd passed multiple sockets, only using the first one", "listen_fds", n)
+	}
+	f := os.NewFile(firstFD, "LISTEN_FD_"+strconv.Itoa(int(firstFD)))
+	// net.FileListener duplicates the file descriptor.
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %v", err)
+	}
+	return ln, nil
+}
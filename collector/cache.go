@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// collection contains the metrics collected by a scrape and its outcome.
+type collection struct {
+	m                 *scrapeMetrics
+	dnsErr, leasesErr error
+	expires           time.Time
+}
+
+// scrapeCache caches collections for Options.CacheDuration, so that scrapes in
+// quick succession (e.g. by multiple Prometheus servers) do not each query
+// dnsmasq and read the leases file. Concurrent scrapes share a single
+// collection.
+type scrapeCache struct {
+	duration time.Duration
+	group    singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]collection // guarded by mu
+}
+
+func newScrapeCache(duration time.Duration) *scrapeCache {
+	return &scrapeCache{
+		duration: duration,
+		entries:  make(map[string]collection),
+	}
+}
+
+// cacheKey identifies the scrapes which can share a collection.
+func cacheKey(t Target, subnets []*net.IPNet) string {
+	parts := []string{t.DnsmasqAddr, t.LeasesPath}
+	for _, subnet := range subnets {
+		parts = append(parts, subnet.String())
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// get returns the cached collection for key if it has not expired yet, and
+// calls collect to replace it otherwise. As the collection is shared by
+// concurrent scrapes, collect is passed a context which is not canceled with
+// ctx, and times out after timeout. Failed collections are not cached, so
+// that the next scrape retries. If ctx is done before the collection, its
+// error is returned.
+func (c *scrapeCache) get(ctx context.Context, key string, timeout time.Duration, collect func(context.Context) collection) (collection, error) {
+	now := time.Now()
+	c.mu.Lock()
+	col, ok := c.entries[key]
+	if ok && now.After(col.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return col, nil
+	}
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		col := collect(shared)
+		if col.dnsErr != nil || col.leasesErr != nil {
+			return col, nil
+		}
+		now := time.Now()
+		col.expires = now.Add(c.duration)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// Drop expired entries, e.g. of subnet URL parameters which are
+		// no longer used.
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = col
+		return col, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(collection), nil
+	case <-ctx.Done():
+		return collection{}, ctx.Err()
+	}
+}
+
+// backgroundCollector collects the default target every
+// Options.CollectInterval, independently of scrapes, which are served the
+// latest collection instead of querying dnsmasq and reading the leases file.
+type backgroundCollector struct {
+	interval time.Duration
+	ready    chan struct{} // closed after the first collection
+
+	mu     sync.Mutex
+	key    string     // guarded by mu, see cacheKey
+	latest collection // guarded by mu
+}
+
+func newBackgroundCollector(interval time.Duration) *backgroundCollector {
+	return &backgroundCollector{
+		interval: interval,
+		ready:    make(chan struct{}),
+	}
+}
+
+// run collects the default target of c every interval until ctx is done. Each
+// collection may take at most the interval.
+func (b *backgroundCollector) run(ctx context.Context, c *Collector) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		// The target is determined anew, as SetLeasesPath may change it.
+		sc := scrapeCollector{c: c, target: c.DefaultTarget(), subnets: c.leaseSubnets}
+		collectCtx, cancel := context.WithTimeout(ctx, b.interval)
+		col := sc.collect(collectCtx)
+		cancel()
+		b.mu.Lock()
+		b.key, b.latest = cacheKey(sc.target, sc.subnets), col
+		b.mu.Unlock()
+		if first {
+			close(b.ready)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// get returns the latest collection if it is of key, waiting for the first
+// collection until ctx is done.
+func (b *backgroundCollector) get(ctx context.Context, key string) (collection, bool) {
+	select {
+	case <-b.ready:
+	case <-ctx.Done():
+		return collection{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.latest, b.key == key
+}
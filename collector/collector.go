@@ -0,0 +1,1645 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector provides a prometheus.Collector for the cache statistics
+// and DHCP leases of a dnsmasq instance. It is the collection logic of
+// dnsmasq_exporter, for use in other programs (e.g. exporters bundling
+// several collectors). The flags of dnsmasq_exporter mentioned in metric help
+// strings correspond to the Options of the same name.
+package collector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTimeout is the timeout of the stats queries if Options.Client is nil.
+const DefaultTimeout = 5 * time.Second
+
+// Options configures a Collector. The zero value is valid: the stats records
+// of dnsmasq are queried over UDP, and all lease metrics are exported.
+type Options struct {
+	// Client sends the stats queries. If nil, UDP is used with
+	// DefaultTimeout.
+	Client *dns.Client
+
+	// DNSRetries is how often a stats query is retried after a transport
+	// error (e.g. a dropped UDP packet).
+	DNSRetries int
+
+	// SplitQuestions sends each stats record in its own message, for DNS
+	// proxies which only answer the first question.
+	SplitQuestions bool
+
+	// SingleInflight shares concurrent identical stats queries.
+	SingleInflight bool
+
+	// ReuseConn keeps TCP (or TLS) connections to dnsmasq open across
+	// scrapes, if Client.Net is tcp or tcp-tls.
+	ReuseConn bool
+
+	// SourceIP and SourcePort are the local address from which stats
+	// queries are sent, if non-zero. They replace the Dialer of Client.
+	SourceIP   net.IP
+	SourcePort int
+
+	// StatsFile is read instead of querying dnsmasq, if non-empty. It
+	// contains the saved output of dig, see readStatsFile.
+	StatsFile string
+
+	// StatsRecords are the CHAOS TXT records (fully qualified) to query. If
+	// nil, DefaultStatsRecords are queried.
+	StatsRecords []string
+
+	// ExtraStats are additional CHAOS TXT records (fully qualified) to
+	// query, exported as dnsmasq_extra_stat.
+	ExtraStats []string
+
+	// QueryID returns the ID for the next stats query. If nil, dns.Id is
+	// used.
+	QueryID func() uint16
+
+	// QnameCase is one of preserve (or empty), lower or random (0x20
+	// encoding), the case of the stats query names.
+	QnameCase string
+
+	// RecursionDesired sets the RD bit on stats queries.
+	RecursionDesired bool
+
+	// UDPBufferSize is advertised in an EDNS0 OPT record on stats queries,
+	// if non-zero.
+	UDPBufferSize uint16
+
+	// NativeHistograms additionally exposes
+	// dnsmasq_dns_query_duration_seconds as a native histogram.
+	NativeHistograms bool
+
+	// MaxLeasesBytes limits the size of leases files, if positive.
+	MaxLeasesBytes int64
+
+	// StrictExpiry skips leases with an unparseable expiry instead of
+	// exporting them with an expiry of -1.
+	StrictExpiry bool
+
+	// KnownMACsFile lists the known MAC addresses, one per line, if
+	// non-empty. Unexpired leases of other MACs are counted in
+	// dnsmasq_leases_unknown_mac, and exported as
+	// dnsmasq_lease_unknown_mac_info with ExposeUnknownMACs. The file is
+	// re-read on every collection.
+	KnownMACsFile     string
+	ExposeUnknownMACs bool
+
+	// ReservationsFile lists "<mac> <ip>" DHCP reservations, one per line,
+	// if non-empty. Like KnownMACsFile, it is re-read on every collection.
+	ReservationsFile string
+
+	// ConfFile and ConfDir are the dnsmasq config file and directory whose
+	// dhcp-range options are exported, if non-empty. They are re-read on
+	// every collection.
+	ConfFile string
+	ConfDir  string
+
+	// OUIs maps MAC prefixes to vendors, see ReadOUIs. If non-nil,
+	// dnsmasq_lease_expiry has a vendor label.
+	OUIs map[string]string
+
+	// HideLeases disables all per-lease series.
+	HideLeases bool
+
+	// MaxLeaseSeries limits the number of leases with per-lease series to
+	// the ones expiring soonest, if positive.
+	MaxLeaseSeries int
+
+	// StripDomain is removed from computer_name labels, if non-empty.
+	StripDomain string
+
+	// LeaseLabels are the LeaseLabels of dnsmasq_lease_expiry, or nil for
+	// all of them.
+	LeaseLabels []string
+
+	// LeaseSubnets restricts per-lease series to leases within these
+	// subnets, unless overridden per Scrape.
+	LeaseSubnets []*net.IPNet
+
+	// LeasePrefixLen and LeasePrefixLenV6 are the prefix lengths by which
+	// leases are grouped in dnsmasq_leases_by_prefix, or 0 to disable
+	// grouping for the address family.
+	LeasePrefixLen   int
+	LeasePrefixLenV6 int
+
+	// LeaseTime is the DHCP lease time configured in dnsmasq, for
+	// dnsmasq_lease_age_seconds. If 0, the age is not exported.
+	LeaseTime time.Duration
+
+	// ResolvePTR looks up the reverse DNS names of lease IPs via dnsmasq,
+	// waiting at most PTRTimeout per collection for uncached lookups.
+	ResolvePTR bool
+	PTRTimeout time.Duration
+
+	// CacheDuration serves the last collection of a target for this long,
+	// if positive.
+	CacheDuration time.Duration
+
+	// CollectInterval collects the default target in the background at
+	// this interval instead of on every scrape, if positive. Run must be
+	// called for the collections to happen.
+	CollectInterval time.Duration
+}
+
+// Target is a dnsmasq instance and its leases file: a comma-separated list of
+// paths and glob patterns for the default target, and a single file
+// otherwise.
+type Target struct {
+	DnsmasqAddr string
+	LeasesPath  string
+}
+
+// Collector queries dnsmasq and reads its leases files. Its Collect scrapes the
+// default target, see Scrape for other targets. Collectors are safe for
+// concurrent use.
+type Collector struct {
+	dnsClient   *dns.Client
+	dnsRetries  int
+	dnsmasqAddr string
+	statsFile   string
+
+	// leasesPath can be changed while collecting, see SetLeasesPath.
+	leasesPathMu sync.RWMutex
+	leasesPath   string // guarded by leasesPathMu
+
+	splitQuestions bool
+
+	// singleInflight shares concurrent identical stats queries in inflight.
+	singleInflight bool
+	inflight       singleflight.Group
+
+	// reuseConn keeps TCP connections to dnsmasq open in dnsConns.
+	reuseConn  bool
+	dnsConnsMu sync.Mutex
+	dnsConns   map[string]*dnsConn // guarded by dnsConnsMu
+
+	maxLeasesBytes int64
+	strictExpiry   bool
+
+	// cache contains recent collections, if non-nil.
+	cache *scrapeCache
+
+	// background collects the default target periodically, if non-nil.
+	background *backgroundCollector
+
+	// lastSuccess maps Targets to the time.Time of their last successful
+	// collection, see dnsmasq_last_scrape_success_timestamp_seconds.
+	lastSuccess sync.Map
+
+	// statsRecords are the CHAOS TXT records (fully qualified) to query. If
+	// nil, DefaultStatsRecords are queried.
+	statsRecords []string
+	extraStats   []string
+
+	// queryDuration records stats query round-trip times.
+	queryDuration prometheus.Histogram
+
+	// queryID returns the ID for the next stats query. If nil, dns.Id is
+	// used.
+	queryID          func() uint16
+	qnameCase        string
+	recursionDesired bool
+	udpBufferSize    uint16
+
+	// sourceIP and sourcePort are the local address from which stats
+	// queries are sent, if non-zero.
+	sourceIP     net.IP
+	sourcePort   int
+	sourcePortMu sync.Mutex
+
+	knownMACsFile     string
+	exposeUnknownMACs bool
+
+	// ouis maps MAC prefixes to vendors. If non-nil, dnsmasq_lease_expiry
+	// has a vendor label.
+	ouis map[string]string
+
+	hideLeases     bool
+	maxLeaseSeries int
+	stripDomain    string
+
+	// leaseLabels are the LeaseLabels of dnsmasq_lease_expiry, or nil for
+	// all of them.
+	leaseLabels []string
+
+	reservationsFile string
+	confFile         string
+	confDir          string
+	leaseSubnets     []*net.IPNet
+	leasePrefixLen   int
+	leasePrefixLenV6 int
+
+	// ptr resolves hostnames of leases without hostname, if non-nil.
+	ptr        *ptrResolver
+	ptrTimeout time.Duration
+
+	// seen contains the (MAC, IP) pairs of all leases observed so far, for
+	// dnsmasq_leases_observed_total. See maxSeenLeases.
+	seenMu sync.Mutex
+	seen   map[string]bool
+
+	// leaseTime is the DHCP lease time configured in dnsmasq, or 0 if unknown.
+	leaseTime time.Duration
+
+	// The metrics which accumulate across scrapes, see scrapeMetrics for the
+	// others.
+	leasesObserved    prometheus.Counter
+	leasesReadRetries prometheus.Counter
+	dnsRetriesTotal   prometheus.Counter
+	dnsReconnects     prometheus.Counter
+	leaseParseErrors  prometheus.Counter
+}
+
+// New returns a Collector for the dnsmasq listening on dnsmasqAddr (host:port)
+// whose leases files are at leasesPath (see Target).
+func New(dnsmasqAddr, leasesPath string, opts Options) *Collector {
+	client := opts.Client
+	if client == nil {
+		client = &dns.Client{Timeout: DefaultTimeout}
+	}
+	c := &Collector{
+		dnsClient:         client,
+		dnsRetries:        opts.DNSRetries,
+		dnsmasqAddr:       dnsmasqAddr,
+		statsFile:         opts.StatsFile,
+		leasesPath:        leasesPath,
+		splitQuestions:    opts.SplitQuestions,
+		singleInflight:    opts.SingleInflight,
+		reuseConn:         opts.ReuseConn,
+		maxLeasesBytes:    opts.MaxLeasesBytes,
+		strictExpiry:      opts.StrictExpiry,
+		statsRecords:      opts.StatsRecords,
+		extraStats:        opts.ExtraStats,
+		queryDuration:     newQueryDuration(opts.NativeHistograms),
+		queryID:           opts.QueryID,
+		qnameCase:         opts.QnameCase,
+		recursionDesired:  opts.RecursionDesired,
+		udpBufferSize:     opts.UDPBufferSize,
+		sourceIP:          opts.SourceIP,
+		sourcePort:        opts.SourcePort,
+		knownMACsFile:     opts.KnownMACsFile,
+		exposeUnknownMACs: opts.ExposeUnknownMACs,
+		ouis:              opts.OUIs,
+		hideLeases:        opts.HideLeases,
+		maxLeaseSeries:    opts.MaxLeaseSeries,
+		stripDomain:       opts.StripDomain,
+		leaseLabels:       opts.LeaseLabels,
+		reservationsFile:  opts.ReservationsFile,
+		confFile:          opts.ConfFile,
+		confDir:           opts.ConfDir,
+		leaseSubnets:      opts.LeaseSubnets,
+		leasePrefixLen:    opts.LeasePrefixLen,
+		leasePrefixLenV6:  opts.LeasePrefixLenV6,
+		leaseTime:         opts.LeaseTime,
+
+		leasesObserved: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_leases_observed_total",
+			Help: "Number of distinct (MAC, IP) DHCP leases observed since the exporter started",
+		}),
+		leasesReadRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_leases_read_retries_total",
+			Help: "Number of times reading the leases file was retried after a transient error",
+		}),
+		dnsRetriesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_dns_retries_total",
+			Help: "Number of times a stats query was retried after a transport error, see -dns_retries",
+		}),
+		dnsReconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_dns_reconnects_total",
+			Help: "Number of times the connection to dnsmasq was re-established after an error, see -dns_reuse_conn",
+		}),
+		leaseParseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_lease_parse_errors_total",
+			Help: "Number of malformed (e.g. truncated) lines skipped when reading the leases file",
+		}),
+	}
+	if c.sourceIP != nil || c.sourcePort != 0 {
+		// The caller's client is left alone.
+		clientCopy := *client
+		clientCopy.Dialer = c.dialer(client.Net)
+		c.dnsClient = &clientCopy
+	}
+	if opts.ResolvePTR {
+		c.ptr = newPTRResolver(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			in, _, err := c.query(ctx, c.dnsClient, c.dnsmasqAddr, msg)
+			return in, err
+		})
+		c.ptrTimeout = opts.PTRTimeout
+	}
+	if opts.CacheDuration > 0 {
+		c.cache = newScrapeCache(opts.CacheDuration)
+	}
+	if opts.CollectInterval > 0 {
+		c.background = newBackgroundCollector(opts.CollectInterval)
+	}
+	return c
+}
+
+// counters returns the metrics which accumulate across scrapes.
+func (c *Collector) counters() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.leasesObserved,
+		c.leasesReadRetries,
+		c.dnsRetriesTotal,
+		c.dnsReconnects,
+		c.leaseParseErrors,
+		c.queryDuration,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.Scrape(context.Background(), c.DefaultTarget(), nil).Describe(ch)
+}
+
+// Collect implements prometheus.Collector, scraping the default target.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.Scrape(context.Background(), c.DefaultTarget(), nil).Collect(ch)
+}
+
+// Scrape returns a prometheus.Collector which collects t on every Collect,
+// unless a background (see Options.CollectInterval) or cached (see
+// Options.CacheDuration) collection is available. The stats queries are
+// aborted when the deadline of ctx expires. If subnets is non-nil, it
+// overrides Options.LeaseSubnets. Along with the metrics of t, the ones which
+// accumulate across scrapes of all targets are collected.
+func (c *Collector) Scrape(ctx context.Context, t Target, subnets []*net.IPNet) prometheus.Collector {
+	if subnets == nil {
+		subnets = c.leaseSubnets
+	}
+	return scrapeCollector{ctx: ctx, c: c, target: t, subnets: subnets}
+}
+
+// Run collects the default target every Options.CollectInterval until ctx is
+// done. It returns immediately without a CollectInterval.
+func (c *Collector) Run(ctx context.Context) {
+	if c.background != nil {
+		c.background.run(ctx, c)
+	}
+}
+
+// Ready returns an error unless dnsmasq answers cachesize.bind. With
+// Options.StatsFile, dnsmasq is not queried.
+func (c *Collector) Ready(ctx context.Context) error {
+	if c.statsFile != "" {
+		return nil
+	}
+	msg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               c.nextQueryID(),
+			RecursionDesired: c.recursionDesired,
+		},
+		Question: []dns.Question{question(c.applyQnameCase("cachesize.bind."))},
+	}
+	in, _, err := c.query(ctx, c.dnsClient, c.dnsmasqAddr, msg)
+	if err == nil && in.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("cachesize.bind: unexpected rcode %s", dns.RcodeToString[in.Rcode])
+	}
+	return err
+}
+
+// Leases returns the records of the leases files of the default target.
+// Missing leases files contain no leases, as for dnsmasq_leases. If the
+// leases path lists multiple files, the File of each lease is set.
+func (c *Collector) Leases(ctx context.Context) ([]Lease, error) {
+	t := c.DefaultTarget()
+	paths, err := c.leasesFiles(t)
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	for _, path := range paths {
+		b, err := readLeasesFile(path, c.maxLeasesBytes, c.leasesReadRetries)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ls, _, err := parseLeases(ctx, b, c.strictExpiry)
+		if err != nil {
+			return nil, err
+		}
+		if c.fileLabel(t) {
+			for i := range ls {
+				ls[i].File = path
+			}
+		}
+		leases = append(leases, ls...)
+	}
+	return leases, nil
+}
+
+// LeaseLabels are the labels of per-lease metrics, in the order of the leases
+// file columns.
+var LeaseLabels = []string{"mac_addr", "ip_addr", "computer_name", "client_id"}
+
+// selectLeaseLabels returns the values (of all LeaseLabels) of the label
+// names, or all values if names is nil.
+func selectLeaseLabels(names, values []string) []string {
+	if names == nil {
+		return append([]string(nil), values...)
+	}
+	selected := make([]string, 0, len(names))
+	for i, l := range LeaseLabels {
+		for _, name := range names {
+			if name == l {
+				selected = append(selected, values[i])
+			}
+		}
+	}
+	return selected
+}
+
+// leaseV6Labels are the labels of per-lease metrics of DHCPv6 leases, in the
+// order of the leases file columns.
+var leaseV6Labels = []string{"iaid", "ip_addr", "computer_name", "client_duid"}
+
+// From https://manpages.debian.org/stretch/dnsmasq-base/dnsmasq.8.en.html:
+// The cache statistics are also available in the DNS as answers to queries of
+// class CHAOS and type TXT in domain bind. The domain names are cachesize.bind,
+// insertions.bind, evictions.bind, misses.bind, hits.bind, auth.bind and
+// servers.bind. An example command to query this, using the dig utility would
+// be:
+//     dig +short chaos txt cachesize.bind
+
+// DefaultStatsRecords are the statistics records answered by dnsmasq, see
+// above.
+var DefaultStatsRecords = []string{
+	"cachesize.bind.",
+	"insertions.bind.",
+	"evictions.bind.",
+	"misses.bind.",
+	"hits.bind.",
+	"auth.bind.",
+	"servers.bind.",
+}
+
+func question(name string) dns.Question {
+	return dns.Question{
+		Name:   name,
+		Qtype:  dns.TypeTXT,
+		Qclass: dns.ClassCHAOS,
+	}
+}
+
+// maxSeenLeases bounds the memory used for dnsmasq_leases_observed_total to a
+// few MB. When the limit is reached, the set of observed leases is cleared, so
+// leases which are still present will be counted again.
+const maxSeenLeases = 65536
+
+// observeLeases increments dnsmasq_leases_observed_total for each lease in
+// keys which has not been observed before.
+func (c *Collector) observeLeases(keys []string) {
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+	if c.seen == nil || len(c.seen) >= maxSeenLeases {
+		c.seen = make(map[string]bool)
+	}
+	for _, key := range keys {
+		if c.seen[key] {
+			continue
+		}
+		c.seen[key] = true
+		c.leasesObserved.Inc()
+	}
+}
+
+// leaseState returns the dnsmasq_leases_by_state state of a lease with the
+// given expiry (Unix timestamp, 0 for infinite leases).
+func leaseState(expiry int64, now time.Time) string {
+	switch {
+	case expiry == 0:
+		return "static"
+	case time.Unix(expiry, 0).Before(now):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// outlives returns whether a lease expiring at a (Unix timestamp, 0 for
+// infinite leases) expires later than one expiring at b.
+func outlives(a, b int64) bool {
+	switch {
+	case b == 0:
+		return false
+	case a == 0:
+		return true
+	default:
+		return a > b
+	}
+}
+
+// expiresSooner returns whether a lease expiring at a (Unix timestamp, 0 for
+// infinite leases, -1 if unknown) expires sooner than one expiring at b.
+// Leases with an unknown expiry come last.
+func expiresSooner(a, b int64) bool {
+	if a < 0 || b < 0 {
+		return a >= 0 && b < 0
+	}
+	return outlives(b, a)
+}
+
+// unknownAsEmpty returns the empty string for "*", which dnsmasq writes to the
+// leases file for clients that sent no hostname or client identifier.
+func unknownAsEmpty(v string) string {
+	if v == "*" {
+		return ""
+	}
+	return v
+}
+
+// normalizeHostname returns hostname without trailing dot and, if domain is
+// non-empty, without the domain suffix (compared case-insensitively), so that
+// a host registering with and without its domain has the same label.
+func normalizeHostname(hostname, domain string) string {
+	hostname = strings.TrimSuffix(hostname, ".")
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return hostname
+	}
+	suffix := "." + domain
+	if len(hostname) > len(suffix) && strings.EqualFold(hostname[len(hostname)-len(suffix):], suffix) {
+		return hostname[:len(hostname)-len(suffix)]
+	}
+	return hostname
+}
+
+// normalizeMAC returns mac in canonical (lower-case, colon-separated) form, or
+// mac itself if it cannot be parsed.
+func normalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return mac
+	}
+	return hw.String()
+}
+
+// readMACs reads a file containing one MAC address per line. Blank lines and
+// lines starting with # are skipped.
+func readMACs(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	macs := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		macs[normalizeMAC(line)] = true
+	}
+	return macs, scanner.Err()
+}
+
+// readStatsFile parses the saved output of e.g.:
+//
+//	dig chaos txt cachesize.bind insertions.bind evictions.bind \
+//	  misses.bind hits.bind auth.bind servers.bind version.bind
+//
+// Comment lines (starting with ;) and blank lines are skipped, all other lines
+// must be resource records in presentation format, as printed in dig’s ANSWER
+// SECTION. Note that dig +short output does not contain the record names and
+// hence cannot be used.
+func readStatsFile(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rrs []dns.RR
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, parseError{fmt.Errorf("%s: %v", path, err)}
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, scanner.Err()
+}
+
+// records returns the (fully qualified) CHAOS TXT records to query: the
+// Options.StatsRecords, version.bind and the Options.ExtraStats, without
+// duplicates.
+func (c *Collector) records() []string {
+	statsRecords := c.statsRecords
+	if statsRecords == nil {
+		statsRecords = DefaultStatsRecords
+	}
+	var records []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{statsRecords, {"version.bind."}, c.extraStats} {
+		for _, name := range list {
+			if lower := strings.ToLower(name); !seen[lower] {
+				seen[lower] = true
+				records = append(records, name)
+			}
+		}
+	}
+	return records
+}
+
+// applyQnameCase returns name in the case configured via Options.QnameCase.
+func (c *Collector) applyQnameCase(name string) string {
+	switch c.qnameCase {
+	case "lower":
+		return strings.ToLower(name)
+	case "random":
+		b := []byte(name)
+		for i, c := range b {
+			if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.Intn(2) == 0 {
+				b[i] ^= 0x20 // flip case
+			}
+		}
+		return string(b)
+	default:
+		return name
+	}
+}
+
+func (c *Collector) nextQueryID() uint16 {
+	if c.queryID == nil {
+		return dns.Id()
+	}
+	return c.queryID()
+}
+
+// dialer returns a net.Dialer binding to the configured source address and
+// port for network, or nil if neither is configured.
+func (c *Collector) dialer(network string) *net.Dialer {
+	if c.sourceIP == nil && c.sourcePort == 0 {
+		return nil
+	}
+	var laddr net.Addr
+	if strings.HasPrefix(network, "tcp") {
+		laddr = &net.TCPAddr{IP: c.sourceIP, Port: c.sourcePort}
+	} else {
+		laddr = &net.UDPAddr{IP: c.sourceIP, Port: c.sourcePort}
+	}
+	timeout := 2 * time.Second // same as the dns.Client default
+	if c.dnsClient != nil && c.dnsClient.Timeout > 0 {
+		timeout = c.dnsClient.Timeout
+	}
+	return &net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: laddr,
+	}
+}
+
+// query sends msg to the dnsmasq at addr using client.
+func (c *Collector) query(ctx context.Context, client *dns.Client, addr string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if c.sourcePort != 0 {
+		// Only one socket can be bound to the source port at a time.
+		c.sourcePortMu.Lock()
+		defer c.sourcePortMu.Unlock()
+	}
+	var in *dns.Msg
+	var rtt time.Duration
+	var err error
+	if c.reuseConn && strings.HasPrefix(client.Net, "tcp") {
+		in, rtt, err = c.dnsConn(addr).exchange(ctx, client, addr, msg)
+	} else {
+		in, rtt, err = client.ExchangeContext(ctx, msg, addr)
+	}
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		args := []interface{}{"addr", addr, "net", client.Net, "rtt", rtt}
+		if len(msg.Question) > 0 {
+			args = append(args, "qname", msg.Question[0].Name)
+		}
+		if in != nil {
+			args = append(args, "rcode", dns.RcodeToString[in.Rcode], "truncated", in.Truncated)
+		}
+		if err != nil {
+			args = append(args, "err", err)
+		}
+		slog.Debug("DNS exchange", args...)
+	}
+	return in, rtt, err
+}
+
+// dnsRetryBackoff is the delay before the first retry of a stats query, which
+// doubles with every further retry.
+const dnsRetryBackoff = 50 * time.Millisecond
+
+// queryWithRetries is like query, but retries up to c.dnsRetries times after
+// transport errors (e.g. a dropped UDP packet), as long as ctx is not done.
+// Error responses from dnsmasq are returned as is.
+func (c *Collector) queryWithRetries(ctx context.Context, client *dns.Client, addr string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	backoff := dnsRetryBackoff
+	for attempt := 0; ; attempt++ {
+		in, rtt, err := c.query(ctx, client, addr, msg)
+		if err == nil || attempt >= c.dnsRetries || ctx.Err() != nil {
+			return in, rtt, err
+		}
+		slog.Debug("retrying DNS query", "addr", addr, "attempt", attempt+1, "err", err)
+		c.dnsRetriesTotal.Inc()
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// observeRTT records the round-trip time of a stats query, with the trace of
+// the scrape request (if any) as exemplar.
+func (c *Collector) observeRTT(ctx context.Context, rtt time.Duration) {
+	if c.queryDuration == nil {
+		return
+	}
+	if tc, ok := traceContextFrom(ctx); ok {
+		c.queryDuration.(prometheus.ExemplarObserver).ObserveWithExemplar(rtt.Seconds(), tc.exemplar())
+		return
+	}
+	c.queryDuration.Observe(rtt.Seconds())
+}
+
+// exchange sends msg to the dnsmasq at addr and returns the reply and its
+// round-trip time. If the reply is truncated because it does not fit into a
+// UDP datagram (e.g. servers.bind with many upstreams), the query is retried
+// over TCP, which sets dnsmasq_dns_tcp_fallback_active in m (the caller resets
+// it), and the returned round-trip time includes both queries. With
+// Options.SingleInflight, concurrent scrapes sending the same questions share
+// one exchange, which is not aborted when one of them is (e.g. by its
+// scrape_timeout), while each scrape stops waiting once its ctx is done.
+func (c *Collector) exchange(ctx context.Context, m *scrapeMetrics, addr string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var r exchangeResult
+	var err error
+	if c.singleInflight {
+		ch := c.inflight.DoChan(inflightKey(addr, msg), func() (interface{}, error) {
+			// The values of ctx (e.g. its trace context) are kept.
+			shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.sharedExchangeTimeout())
+			defer cancel()
+			return c.exchangeOnce(shared, addr, msg)
+		})
+		select {
+		case res := <-ch:
+			r, err = res.Val.(exchangeResult), res.Err
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	} else {
+		r, err = c.exchangeOnce(ctx, addr, msg)
+	}
+	if r.tcpFallback {
+		m.tcpFallback.Set(1)
+	}
+	return r.in, r.rtt, err
+}
+
+// sharedExchangeTimeout bounds an exchange shared by concurrent scrapes: the
+// stats query timeout for every retry, over both UDP and TCP.
+func (c *Collector) sharedExchangeTimeout() time.Duration {
+	timeout := DefaultTimeout
+	if c.dnsClient.Timeout > 0 {
+		timeout = c.dnsClient.Timeout
+	}
+	return 2 * time.Duration(c.dnsRetries+1) * timeout
+}
+
+// exchangeResult is the outcome of exchangeOnce, which may be shared by
+// concurrent scrapes (see Options.SingleInflight). in must not be modified.
+type exchangeResult struct {
+	in          *dns.Msg
+	rtt         time.Duration
+	tcpFallback bool
+}
+
+// inflightKey identifies the stats queries whose answer can be shared: the
+// same questions (in the same case, see Options.QnameCase) to the same dnsmasq.
+func inflightKey(addr string, msg *dns.Msg) string {
+	parts := []string{addr}
+	for _, q := range msg.Question {
+		parts = append(parts, q.String())
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// exchangeOnce sends msg, retrying over TCP if the answer is truncated.
+func (c *Collector) exchangeOnce(ctx context.Context, addr string, msg *dns.Msg) (exchangeResult, error) {
+	in, rtt, err := c.queryWithRetries(ctx, c.dnsClient, addr, msg)
+	if err != nil {
+		return exchangeResult{}, err
+	}
+	c.observeRTT(ctx, rtt)
+	if !in.Truncated || strings.HasPrefix(c.dnsClient.Net, "tcp") {
+		return exchangeResult{in: in, rtt: rtt}, nil
+	}
+	tcpClient := &dns.Client{
+		Net:     "tcp",
+		Timeout: c.dnsClient.Timeout,
+		Dialer:  c.dialer("tcp"),
+	}
+	udpRTT := rtt
+	in, rtt, err = c.queryWithRetries(ctx, tcpClient, addr, msg)
+	if err != nil {
+		return exchangeResult{}, err
+	}
+	c.observeRTT(ctx, rtt)
+	return exchangeResult{in: in, rtt: udpRTT + rtt, tcpFallback: true}, nil
+}
+
+// upstream contains the statistics of an upstream server from servers.bind.
+type upstream struct {
+	server  string
+	queries float64
+	failed  float64
+}
+
+// parseServers parses the strings of a servers.bind TXT record, each of which
+// contains one or more space-separated "<server> <queries> <failed>" triples.
+func parseServers(txt []string) ([]upstream, error) {
+	fields := strings.Fields(strings.Join(txt, " "))
+	if len(fields)%3 != 0 {
+		return nil, fmt.Errorf("malformed servers.bind answer %q: got %d fields, want a multiple of 3", txt, len(fields))
+	}
+	var upstreams []upstream
+	for i := 0; i < len(fields); i += 3 {
+		queries, err := strconv.ParseFloat(fields[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		failed, err := strconv.ParseFloat(fields[i+2], 64)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream{
+			server:  fields[i],
+			queries: queries,
+			failed:  failed,
+		})
+	}
+	return upstreams, nil
+}
+
+// readReservations reads a file containing one "<mac> <ip>" pair per line and
+// returns the reserved IP keyed by MAC. Blank lines and lines starting with #
+// are skipped.
+func readReservations(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reserved := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if got, want := len(parts), 2; got != want {
+			return nil, fmt.Errorf("%s: malformed reservation %q: got %d fields, want %d", path, line, got, want)
+		}
+		reserved[normalizeMAC(parts[0])] = parts[1]
+	}
+	return reserved, scanner.Err()
+}
+
+func newQueryDuration(native bool) prometheus.Histogram {
+	opts := prometheus.HistogramOpts{
+		Name:    "dnsmasq_dns_query_duration_seconds",
+		Help:    "Round-trip time of the stats queries to dnsmasq",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}
+	if native {
+		// Classic buckets are still exposed alongside the native
+		// histogram for Prometheus servers without native histograms.
+		opts.NativeHistogramBucketFactor = 1.1
+		opts.NativeHistogramMaxBucketNumber = 100
+		opts.NativeHistogramMinResetDuration = 1 * time.Hour
+	}
+	return prometheus.NewHistogram(opts)
+}
+
+func (m *scrapeMetrics) observePhase(phase string, start time.Time) {
+	m.scrapePhaseDuration.WithLabelValues(phase).Set(time.Since(start).Seconds())
+}
+
+// scrapeResults are the values of the result label of dnsmasq_scrape_result.
+var scrapeResults = []string{"ok", "dns_failed", "leases_failed", "both_failed", "timeout"}
+
+// isTimeout returns whether err is caused by a timeout, e.g. of the stats
+// query.
+func isTimeout(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// parseError is an error parsing the stats answers (or Options.StatsFile), see
+// errorReason.
+type parseError struct {
+	err error
+}
+
+func (e parseError) Error() string { return e.err.Error() }
+
+func (e parseError) Unwrap() error { return e.err }
+
+// rcodeError is a stats reply with an error rcode, e.g. REFUSED if dnsmasq
+// is configured not to answer the exporter.
+type rcodeError struct {
+	rcode int
+}
+
+func (e rcodeError) Error() string {
+	return fmt.Sprintf("stats query: unexpected rcode %s", dns.RcodeToString[e.rcode])
+}
+
+// errorReason returns the reason label of dnsmasq_scrape_error for the errors
+// of a failed scrape. Only one reason is returned, preferring DNS errors.
+func errorReason(dnsErr, leasesErr error) string {
+	var pe parseError
+	var re rcodeError
+	var pathErr *fs.PathError
+	switch {
+	case isTimeout(dnsErr):
+		return "dns_timeout"
+	case errors.As(dnsErr, &pe):
+		return "dns_parse"
+	case errors.As(dnsErr, &re):
+		return "dns_rcode"
+	case dnsErr != nil:
+		return "dns_error"
+	case isTimeout(leasesErr) || errors.Is(leasesErr, context.Canceled):
+		return "leases_timeout"
+	case errors.As(leasesErr, &pathErr) && pathErr.Op == "open":
+		// Includes Options.KnownMACsFile, Options.ReservationsFile etc.
+		return "leases_open"
+	default:
+		return "leases_read"
+	}
+}
+
+// setScrapeResult sets dnsmasq_scrape_result, dnsmasq_scrape_error and
+// dnsmasq_up. A timeout takes precedence over the failure of the respective
+// subsystem(s).
+func (m *scrapeMetrics) setScrapeResult(dnsErr, leasesErr error) {
+	result := "ok"
+	switch {
+	case isTimeout(dnsErr) || isTimeout(leasesErr):
+		result = "timeout"
+	case dnsErr != nil && leasesErr != nil:
+		result = "both_failed"
+	case dnsErr != nil:
+		result = "dns_failed"
+	case leasesErr != nil:
+		result = "leases_failed"
+	}
+	for _, r := range scrapeResults {
+		v := 0.0
+		if r == result {
+			v = 1
+		}
+		m.scrapeResult.WithLabelValues(r).Set(v)
+	}
+	if result == "ok" {
+		m.up.Set(1)
+	} else {
+		m.up.Set(0)
+		m.scrapeError.WithLabelValues(errorReason(dnsErr, leasesErr)).Set(1)
+	}
+}
+
+// collect queries dnsmasq and reads the leases file of t, updating the
+// metrics in m. The stats queries are aborted when the deadline of ctx
+// expires. If subnets is non-empty, per-lease series are only exported for
+// leases with an IP in one of the subnets. The outcome is recorded in
+// dnsmasq_up and dnsmasq_scrape_result.
+func (c *Collector) collect(ctx context.Context, m *scrapeMetrics, t Target, subnets []*net.IPNet) (dnsErr, leasesErr error) {
+	defer m.observePhase("total", time.Now())
+
+	collectDNS := func() error {
+		defer m.observePhase("dns", time.Now())
+		records := c.records()
+		var answers []dns.RR
+		if c.statsFile != "" {
+			rrs, err := readStatsFile(c.statsFile)
+			if err != nil {
+				return err
+			}
+			answers = rrs
+		} else {
+			m.tcpFallback.Set(0)
+			// msgs contains the questions for all records in one message,
+			// or one message per record with Options.SplitQuestions.
+			var msgs []*dns.Msg
+			for _, name := range records {
+				if len(msgs) == 0 || c.splitQuestions {
+					msgs = append(msgs, &dns.Msg{
+						MsgHdr: dns.MsgHdr{
+							Id:               c.nextQueryID(),
+							RecursionDesired: c.recursionDesired,
+						},
+					})
+				}
+				msg := msgs[len(msgs)-1]
+				msg.Question = append(msg.Question, question(c.applyQnameCase(name)))
+			}
+			if c.udpBufferSize > 0 {
+				for _, msg := range msgs {
+					msg.SetEdns0(c.udpBufferSize, false)
+				}
+			}
+			replies := make([]*dns.Msg, len(msgs))
+			rtts := make([]time.Duration, len(msgs))
+			errs := make([]error, len(msgs))
+			var wg sync.WaitGroup
+			for i, msg := range msgs {
+				wg.Add(1)
+				go func(i int, msg *dns.Msg) {
+					defer wg.Done()
+					replies[i], rtts[i], errs[i] = c.exchange(ctx, m, t.DnsmasqAddr, msg)
+				}(i, msg)
+			}
+			wg.Wait()
+			var rtt time.Duration
+			for i, in := range replies {
+				if errs[i] != nil {
+					return errs[i]
+				}
+				// Without answers, e.g. with REFUSED, the scrape would
+				// otherwise succeed without any stats.
+				if in.Rcode != dns.RcodeSuccess {
+					m.dnsRcode.WithLabelValues(dns.RcodeToString[in.Rcode]).Set(1)
+					return rcodeError{rcode: in.Rcode}
+				}
+			}
+			m.dnsRcode.WithLabelValues(dns.RcodeToString[dns.RcodeSuccess]).Set(1)
+			for i, in := range replies {
+				answers = append(answers, in.Answer...)
+				// The queries are sent concurrently, so the slowest one
+				// determines how long the scrape waited for dnsmasq.
+				if rtts[i] > rtt {
+					rtt = rtts[i]
+				}
+			}
+			m.dnsRTT.WithLabelValues().Set(rtt.Seconds())
+		}
+		requested := make(map[string]bool)
+		for _, name := range records {
+			requested[strings.ToLower(name)] = true
+		}
+		for name := range m.stats {
+			if !requested[name] {
+				delete(m.stats, name) // not exported
+			}
+		}
+		// Records which dnsmasq does not answer are absent from the
+		// output rather than failing the scrape. Answers to records which
+		// were not requested (e.g. in Options.StatsFile) are ignored.
+		var version string
+		// servers contains the distinct upstream servers, or is nil if
+		// servers.bind was not answered.
+		var servers map[string]bool
+		// values contains the parsed stats, keyed by record name.
+		values := make(map[string]float64)
+		for _, a := range answers {
+			txt, ok := a.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			// Names are compared case-insensitively, as dnsmasq echoes the
+			// case of the question (see Options.QnameCase).
+			name := strings.ToLower(txt.Hdr.Name)
+			if !requested[name] {
+				continue
+			}
+			switch name {
+			case "version.bind.":
+				version = strings.Join(txt.Txt, "")
+			case "servers.bind.":
+				// Note that dnsmasq does not report which protocol (UDP, TCP
+				// or DoT) was used for the queries, so the per-server metrics
+				// cannot have a protocol label.
+				upstreams, err := parseServers(txt.Txt)
+				if err != nil {
+					slog.Warn("could not parse servers.bind", "err", err)
+					break
+				}
+				if servers == nil {
+					servers = make(map[string]bool)
+				}
+				for _, u := range upstreams {
+					m.serversQueries.WithLabelValues(u.server).Add(u.queries)
+					m.serversQueriesFailed.WithLabelValues(u.server).Add(u.failed)
+					servers[u.server] = true
+				}
+			default:
+				g, ok := m.stats[name]
+				if !ok {
+					// Records without a dedicated metric are skipped
+					// unless they have a numeric value.
+					if f, err := strconv.ParseFloat(strings.Join(txt.Txt, ""), 64); err == nil {
+						m.extraStat.WithLabelValues(name).Set(f)
+					}
+					continue
+				}
+				// Some proxies split the value into multiple
+				// character-strings.
+				f, err := strconv.ParseFloat(strings.Join(txt.Txt, ""), 64)
+				if err != nil {
+					return parseError{fmt.Errorf("stats DNS record %q: %v", txt.Hdr.Name, err)}
+				}
+				g.Set(f)
+				values[name] = f
+			}
+		}
+		if servers != nil {
+			m.serversCount.WithLabelValues().Set(float64(len(servers)))
+		}
+		// hits.bind counts all queries answered locally, which includes
+		// queries for authoritative zones (auth.bind).
+		hits, okHits := values["hits.bind."]
+		auth, okAuth := values["auth.bind."]
+		if okHits && okAuth {
+			m.cacheHitsOnly.Set(math.Max(hits-auth, 0))
+		}
+		// Without any queries, the ratio is undefined and left out.
+		misses, okMisses := values["misses.bind."]
+		if okHits && okMisses && hits+misses > 0 {
+			m.cacheHitRatio.WithLabelValues().Set(hits / (hits + misses))
+		}
+		// With cache-size=0, the cache is disabled and the utilization is
+		// undefined.
+		size, okSize := values["cachesize.bind."]
+		insertions, okInsertions := values["insertions.bind."]
+		if okSize && okInsertions && size > 0 {
+			m.cacheUtilization.WithLabelValues().Set(math.Max(math.Min(insertions, size)/size, 0))
+		}
+		if version != "" {
+			m.versionInfo.WithLabelValues(version).Set(1)
+		}
+		// Other DNS servers (e.g. BIND or unbound) answer version.bind, but
+		// not cachesize.bind, and return NXDOMAIN or REFUSED for unknown
+		// CHAOS records.
+		_, cachesize := values["cachesize.bind."]
+		if (cachesize || !requested["cachesize.bind."]) && (version == "" || strings.HasPrefix(version, "dnsmasq-")) {
+			m.isDnsmasq.Set(1)
+		} else {
+			m.isDnsmasq.Set(0)
+			slog.Warn("server does not look like dnsmasq, check the -dnsmasq flag", "addr", t.DnsmasqAddr, "version", version, "cachesize_answered", cachesize)
+		}
+		return nil
+	}
+
+	collectLeases := func() error {
+		defer m.observePhase("leases", time.Now())
+		paths, err := c.leasesFiles(t)
+		if err != nil {
+			return err
+		}
+		fileLabel := c.fileLabel(t)
+		// PTR lookups are always sent to (and cached for) the configured
+		// dnsmasq, so they are skipped for other targets.
+		ptr := c.ptr
+		if t != c.DefaultTarget() {
+			ptr = nil
+		}
+		var knownMACs map[string]bool
+		if c.knownMACsFile != "" {
+			knownMACs, err = readMACs(c.knownMACsFile)
+			if err != nil {
+				return err
+			}
+		}
+		var reserved map[string]string
+		if c.reservationsFile != "" {
+			reserved, err = readReservations(c.reservationsFile)
+			if err != nil {
+				return err
+			}
+		}
+		ranges, err := c.dhcpRanges()
+		if err != nil {
+			return err
+		}
+		rangeUsed := make([]float64, len(ranges))
+		// leaseIPs contains the leased IPs of reserved MACs.
+		leaseIPs := make(map[string][]string)
+		byPrefix := make(map[string]float64)
+		byState := map[string]float64{"active": 0, "expired": 0, "static": 0}
+		// latest contains the expiry of the exported lease per label set, as
+		// records with identical labels occur transiently during renewals.
+		latest := make(map[string]int64)
+		isLatest := func(labels []string, expiry int64) bool {
+			key := strings.Join(labels, "\x00")
+			if prev, ok := latest[key]; ok {
+				slog.Debug("duplicate lease", "labels", labels, "expiry", expiry, "previous_expiry", prev)
+				if !outlives(expiry, prev) {
+					return false
+				}
+			}
+			latest[key] = expiry
+			return true
+		}
+		var observed []string
+		// clientIDs and clientMACs contain the distinct client identifiers
+		// and the MACs of leases with a client identifier.
+		clientIDs := make(map[string]bool)
+		clientMACs := make(map[string]bool)
+		// hostnameMACs contains the distinct MACs per (lower case)
+		// hostname, for dnsmasq_lease_hostname_collisions. Multiple
+		// records of the same client are not collisions.
+		hostnameMACs := make(map[string]map[string]bool)
+		now := time.Now()
+		ptrDeadline := now.Add(c.ptrTimeout)
+		// files contains the parsed leases files which exist.
+		type leasesFile struct {
+			path       string
+			fileLabels []string
+			leases     []Lease
+		}
+		var files []leasesFile
+		for _, path := range paths {
+			// fileLabels are the label values of per-file metrics, and are
+			// appended to the dnsmasq_lease_expiry* labels.
+			var fileLabels []string
+			if fileLabel {
+				fileLabels = []string{path}
+			}
+			// The leases file is opened by path on every scrape, so that a
+			// rotated or replaced file is picked up.
+			if fi, err := os.Stat(path); err == nil {
+				if ino, ok := inode(fi); ok {
+					m.leasesFileInode.WithLabelValues(fileLabels...).Set(float64(ino))
+				}
+				m.leasesFileMtime.WithLabelValues(fileLabels...).Set(float64(fi.ModTime().UnixNano()) / 1e9)
+			}
+			b, err := readLeasesFile(path, c.maxLeasesBytes, c.leasesReadRetries)
+			if os.IsNotExist(err) {
+				// dnsmasq does not create the leases file if DHCP is
+				// disabled.
+				slog.Debug("leases file does not exist", "path", path)
+				m.leasesFilePresent.WithLabelValues(fileLabels...).Set(0)
+				m.leases.WithLabelValues(fileLabels...).Set(0)
+				m.leasesFileBytes.WithLabelValues(fileLabels...).Set(0)
+				m.leasesParsedRecords.WithLabelValues(fileLabels...).Set(0)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			m.leasesFilePresent.WithLabelValues(fileLabels...).Set(1)
+			m.leasesFileBytes.WithLabelValues(fileLabels...).Set(float64(len(b)))
+			leases, malformed, err := parseLeases(ctx, b, c.strictExpiry)
+			if err != nil {
+				return err
+			}
+			c.leaseParseErrors.Add(float64(malformed))
+			m.leasesParsedRecords.WithLabelValues(fileLabels...).Set(float64(len(leases)))
+			lines := float64(len(leases))
+			slog.Debug("parsed leases file", "path", path, "records", lines)
+			m.leases.WithLabelValues(fileLabels...).Set(lines)
+			files = append(files, leasesFile{path: path, fileLabels: fileLabels, leases: leases})
+		}
+		// wanted returns whether to export per-lease series of l, unless
+		// limited by Options.MaxLeaseSeries.
+		wanted := func(l Lease) bool {
+			return !c.hideLeases && (len(subnets) == 0 || inSubnets(l.IP, subnets))
+		}
+		// limited contains the indexes (of file and lease) of the leases
+		// with per-lease series, or is nil if Options.MaxLeaseSeries is not
+		// exceeded.
+		var limited map[[2]int]bool
+		var truncated int
+		if c.maxLeaseSeries > 0 {
+			var candidates [][2]int
+			for i, f := range files {
+				for j, l := range f.leases {
+					if wanted(l) {
+						candidates = append(candidates, [2]int{i, j})
+					}
+				}
+			}
+			if len(candidates) > c.maxLeaseSeries {
+				expiry := func(c [2]int) int64 { return files[c[0]].leases[c[1]].Expiry }
+				sort.SliceStable(candidates, func(i, j int) bool {
+					return expiresSooner(expiry(candidates[i]), expiry(candidates[j]))
+				})
+				limited = make(map[[2]int]bool)
+				for _, c := range candidates[:c.maxLeaseSeries] {
+					limited[c] = true
+				}
+				truncated = len(candidates) - c.maxLeaseSeries
+			}
+		}
+		m.leasesTruncated.Set(float64(truncated))
+		var unknown, missingClientID, hostnameMismatch float64
+		for i, f := range files {
+			fileLabels := f.fileLabels
+			for j, l := range f.leases {
+				if l.Expiry >= 0 {
+					byState[leaseState(l.Expiry, now)]++
+				}
+				if prefix, ok := leasePrefix(l.IP, c.leasePrefixLen, c.leasePrefixLenV6); ok {
+					byPrefix[prefix]++
+				}
+				// detailed is whether to export per-lease series.
+				detailed := wanted(l) && (limited == nil || limited[[2]int{i, j}])
+				hostname := normalizeHostname(l.Hostname, c.stripDomain)
+				if l.V6 {
+					if detailed {
+						labels := append([]string{l.IAID, l.IP, hostname, l.ClientDUID}, fileLabels...)
+						if isLatest(append([]string{"v6"}, labels...), l.Expiry) {
+							m.leaseExpiryV6.WithLabelValues(labels...).Set(float64(l.Expiry))
+						}
+					}
+					continue
+				}
+				if l.missingClientID {
+					missingClientID++
+				}
+				mac := l.MAC
+				if hostname != "" {
+					name := strings.ToLower(hostname)
+					if hostnameMACs[name] == nil {
+						hostnameMACs[name] = make(map[string]bool)
+					}
+					hostnameMACs[name][mac] = true
+				}
+				// ptrName is empty if the lookup failed or timed out.
+				var ptrName string
+				if ptr != nil && (hostname != "" || detailed) {
+					if name, ok := ptr.lookup(l.IP, ptrDeadline); ok {
+						ptrName = name
+						if hostname == "" {
+							hostname = name
+						} else if !hostnameMatches(hostname, name) {
+							hostnameMismatch++
+						}
+					}
+				}
+				if detailed {
+					labels := []string{mac, l.IP, hostname, l.ClientID}
+					expiryLabels := selectLeaseLabels(c.leaseLabels, labels)
+					if c.ouis != nil {
+						expiryLabels = append(expiryLabels, vendor(c.ouis, mac))
+					}
+					if c.ptr != nil {
+						expiryLabels = append(expiryLabels, ptrName)
+					}
+					expiryLabels = append(expiryLabels, fileLabels...)
+					if isLatest(append([]string{"expiry"}, expiryLabels...), l.Expiry) {
+						m.leaseExpiry.WithLabelValues(expiryLabels...).Set(float64(l.Expiry))
+						// An expiry of 0 denotes an infinite lease, which has
+						// neither a TTL nor an age.
+						remaining := time.Unix(l.Expiry, 0).Sub(now)
+						if l.Expiry > 0 {
+							m.leaseTTL.WithLabelValues(expiryLabels...).Set(remaining.Seconds())
+						} else {
+							m.leaseTTL.DeleteLabelValues(expiryLabels...)
+						}
+						if c.leaseTime > 0 && l.Expiry > 0 {
+							m.leaseAge.WithLabelValues(expiryLabels...).Set((c.leaseTime - remaining).Seconds())
+						} else {
+							m.leaseAge.DeleteLabelValues(expiryLabels...)
+						}
+					}
+				}
+				observed = append(observed, mac+" "+l.IP)
+				if l.ClientID != "" {
+					clientIDs[l.ClientID] = true
+					clientMACs[mac] = true
+				}
+				if ip, ok := parseIPv4(l.IP); ok {
+					for i, r := range ranges {
+						if r.contains(ip) {
+							rangeUsed[i]++
+						}
+					}
+				}
+				if _, ok := reserved[mac]; ok {
+					leaseIPs[mac] = append(leaseIPs[mac], l.IP)
+				}
+				if knownMACs == nil || knownMACs[mac] {
+					continue
+				}
+				if leaseState(l.Expiry, now) == "expired" {
+					continue
+				}
+				unknown++
+				if detailed && c.exposeUnknownMACs {
+					m.unknownMACLeaseInfo.WithLabelValues(mac, l.IP).Set(1)
+				}
+			}
+		}
+		for state, n := range byState {
+			m.leasesByState.WithLabelValues(state).Set(n)
+		}
+		m.leasesActive.Set(byState["active"] + byState["static"])
+		m.unknownMACLeases.Set(unknown)
+		m.leasesMissingClientID.Set(missingClientID)
+		if ptr != nil {
+			m.leaseHostnameMismatch.Set(hostnameMismatch)
+		}
+		m.uniqueClientIDs.Set(float64(len(clientIDs)))
+		var collisions []string
+		for name, macs := range hostnameMACs {
+			if len(macs) > 1 {
+				collisions = append(collisions, name)
+			}
+		}
+		if len(collisions) > 0 {
+			sort.Strings(collisions)
+			slog.Debug("hostnames of multiple leases", "hostnames", collisions)
+		}
+		m.hostnameCollisions.Set(float64(len(collisions)))
+		m.clientIDMACMismatch.Set(math.Abs(float64(len(clientIDs) - len(clientMACs))))
+		c.observeLeases(observed)
+		for prefix, n := range byPrefix {
+			m.leasesByPrefix.WithLabelValues(prefix).Set(n)
+		}
+		var active, mismatch float64
+		for mac, ip := range reserved {
+			ips, ok := leaseIPs[mac]
+			if !ok {
+				continue
+			}
+			found := false
+			for _, leased := range ips {
+				if leased == ip {
+					found = true
+					break
+				}
+			}
+			if found {
+				active++
+			} else {
+				mismatch++
+			}
+		}
+		m.reservations.Set(float64(len(reserved)))
+		m.reservationsActive.Set(active)
+		m.reservationsMismatch.Set(mismatch)
+		for i, r := range ranges {
+			m.dhcpRangeSize.WithLabelValues(r.tag, r.String()).Set(r.size())
+			m.dhcpRangeUsed.WithLabelValues(r.tag, r.String()).Set(rangeUsed[i])
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dnsErr = collectDNS()
+	}()
+	go func() {
+		defer wg.Done()
+		leasesErr = collectLeases()
+	}()
+	wg.Wait()
+	m.setScrapeResult(dnsErr, leasesErr)
+	if dnsErr == nil && leasesErr == nil {
+		c.lastSuccess.Store(t, time.Now())
+	}
+	if last, ok := c.lastSuccess.Load(t); ok {
+		m.lastSuccess.WithLabelValues().Set(float64(last.(time.Time).UnixNano()) / 1e9)
+	}
+	return dnsErr, leasesErr
+}
+
+func inSubnets(ip string, subnets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// leasePrefix returns the prefix of ip for grouping leases in
+// dnsmasq_leases_by_prefix, i.e. ip masked to prefixLen4 or prefixLen6 bits,
+// or false if the prefix length for the address family is 0.
+func leasePrefix(ip string, prefixLen4, prefixLen6 int) (string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+	prefixLen, bits := prefixLen6, 8*net.IPv6len
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, prefixLen, bits = v4, prefixLen4, 8*net.IPv4len
+	}
+	if prefixLen <= 0 {
+		return "", false
+	}
+	mask := net.CIDRMask(prefixLen, bits)
+	prefix := net.IPNet{IP: parsed.Mask(mask), Mask: mask}
+	return prefix.String(), true
+}
+
+// leasesFiles returns the leases files of t. For the leases path of the
+// default target, these are its comma-separated paths, with glob patterns
+// expanded. Other leases paths (e.g. the leases_path URL parameter of the
+// exporter) are used as is.
+func (c *Collector) leasesFiles(t Target) ([]string, error) {
+	if t.LeasesPath != c.LeasesPath() {
+		return []string{t.LeasesPath}, nil
+	}
+	var paths []string
+	for _, pattern := range strings.Split(t.LeasesPath, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 && !hasGlobMeta(pattern) {
+			// Report the file as missing, see dnsmasq_leases_file_present.
+			matches = []string{pattern}
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// fileLabel returns whether the metrics of t's leases files have a file label,
+// which is the case if the leases path of the default target lists multiple
+// files or a glob pattern.
+func (c *Collector) fileLabel(t Target) bool {
+	return t.LeasesPath == c.LeasesPath() &&
+		(strings.Contains(t.LeasesPath, ",") || hasGlobMeta(t.LeasesPath))
+}
+
+// LeasesPath returns the leases path of the default target.
+func (c *Collector) LeasesPath() string {
+	c.leasesPathMu.RLock()
+	defer c.leasesPathMu.RUnlock()
+	return c.leasesPath
+}
+
+// SetLeasesPath changes the leases path of the default target, e.g. when the
+// exporter reloads its config file.
+func (c *Collector) SetLeasesPath(path string) {
+	c.leasesPathMu.Lock()
+	defer c.leasesPathMu.Unlock()
+	c.leasesPath = path
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// DefaultTarget returns the target passed to New, with the current
+// LeasesPath.
+func (c *Collector) DefaultTarget() Target {
+	return Target{
+		DnsmasqAddr: c.dnsmasqAddr,
+		LeasesPath:  c.LeasesPath(),
+	}
+}
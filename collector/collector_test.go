@@ -0,0 +1,2144 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/dnsmasq_exporter/collector/collectortest"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gather scrapes the default target of c, returning the metrics in the text
+// exposition format. Unlike fetchMetrics, it can be used concurrently.
+func gather(ctx context.Context, c *Collector, subnets []*net.IPNet) (string, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c.Scrape(ctx, c.DefaultTarget(), subnets)); err != nil {
+		return "", err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+func fetchMetrics(t *testing.T, c *Collector) map[string]string {
+	t.Helper()
+	text, err := gather(context.Background(), c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collectortest.ParseMetrics(text)
+}
+
+func TestStatsFile(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_cachesize":                                   "150",
+		"dnsmasq_insertions":                                  "4117",
+		"dnsmasq_evictions":                                   "3509",
+		"dnsmasq_misses":                                      "9507",
+		"dnsmasq_hits":                                        "21306",
+		"dnsmasq_auth":                                        "0",
+		"dnsmasq_is_dnsmasq":                                  "1",
+		"dnsmasq_cache_hits_only":                             "21306",
+		"dnsmasq_cache_hit_ratio":                             strconv.FormatFloat(21306.0/(21306+9507), 'g', -1, 64),
+		"dnsmasq_cache_utilization":                           "1",
+		`dnsmasq_version_info{version="dnsmasq-2.90"}`:        "1",
+		`dnsmasq_servers_queries{server="8.8.8.8#53"}`:        "6419",
+		`dnsmasq_servers_queries_failed{server="8.8.8.8#53"}`: "2",
+		`dnsmasq_servers_queries{server="8.8.4.4#53"}`:        "3090",
+		`dnsmasq_servers_queries_failed{server="8.8.4.4#53"}`: "0",
+		"dnsmasq_servers_count":                               "2",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestParseServers(t *testing.T) {
+	got, err := parseServers([]string{"8.8.8.8#53 10 1 1.1.1.1#53 5 0", "[2001:4860:4860::8888]#53 3 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []upstream{
+		{server: "8.8.8.8#53", queries: 10, failed: 1},
+		{server: "1.1.1.1#53", queries: 5, failed: 0},
+		{server: "[2001:4860:4860::8888]#53", queries: 3, failed: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseServers: got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseServers([]string{"8.8.8.8#53 10"}); err == nil {
+		t.Errorf("parseServers: got nil error for a truncated triple")
+	}
+}
+
+func TestKnownMACs(t *testing.T) {
+	for _, tt := range []struct {
+		leasesPath string
+		want       map[string]string
+	}{
+		{"../testdata/dnsmasq.leases", map[string]string{
+			"dnsmasq_leases":             "2",
+			"dnsmasq_leases_unknown_mac": "1",
+			`dnsmasq_lease_unknown_mac_info{ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`: "1",
+		}},
+		// The expired lease of an unknown MAC is not counted, the static one
+		// is.
+		{"../testdata/lease_states.leases", map[string]string{
+			"dnsmasq_leases":             "3",
+			"dnsmasq_leases_unknown_mac": "1",
+			`dnsmasq_lease_unknown_mac_info{ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`: "",
+			`dnsmasq_lease_unknown_mac_info{ip_addr="192.168.1.12",mac_addr="aa:bb:cc:dd:ee:ff"}`: "1",
+		}},
+	} {
+		c := New("", tt.leasesPath, Options{
+			StatsFile:         "../testdata/dig.txt",
+			KnownMACsFile:     "../testdata/known_macs",
+			ExposeUnknownMACs: true,
+		})
+		metrics := fetchMetrics(t, c)
+		for key, val := range tt.want {
+			if got, want := metrics[key], val; got != want {
+				t.Errorf("%s: metric %q: got %q, want %q", tt.leasesPath, key, got, want)
+			}
+		}
+	}
+}
+
+func TestLeaseAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	leasesPath := filepath.Join(dir, "dnsmasq.leases")
+	expiry := time.Now().Add(1 * time.Hour).Unix()
+	leases := fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.10 laptop 01:00:11:22:33:44:55\n"+
+		"0 66:77:88:99:aa:bb 192.168.1.11 * *\n", expiry)
+	if err := ioutil.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New("", leasesPath, Options{
+		StatsFile: "../testdata/dig.txt",
+		LeaseTime: 12 * time.Hour,
+	})
+	metrics := fetchMetrics(t, c)
+	labels := `{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`
+	got, err := strconv.ParseFloat(metrics["dnsmasq_lease_expiry"+labels], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := float64(expiry); got != want {
+		t.Errorf("dnsmasq_lease_expiry: got %v, want %v", got, want)
+	}
+	age, err := strconv.ParseFloat(metrics["dnsmasq_lease_age_seconds"+labels], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age < (11*time.Hour).Seconds() || age > (11*time.Hour+time.Minute).Seconds() {
+		t.Errorf("dnsmasq_lease_age_seconds: got %v, want approximately 11h", age)
+	}
+	infinite := `{client_id="",computer_name="",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`
+	if got, ok := metrics["dnsmasq_lease_age_seconds"+infinite]; ok {
+		t.Errorf("dnsmasq_lease_age_seconds unexpectedly present for infinite lease: %q", got)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{
+		StatsFile:        "../testdata/dig.txt",
+		ReservationsFile: "../testdata/reservations",
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_reservations":             "3",
+		"dnsmasq_reservations_active":      "1",
+		"dnsmasq_reservations_ip_mismatch": "1",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLeasesByPrefix(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{
+		StatsFile:      "../testdata/dig.txt",
+		LeasePrefixLen: 24,
+	})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics[`dnsmasq_leases_by_prefix{prefix="192.168.1.0/24"}`], "2"; got != want {
+		t.Errorf("dnsmasq_leases_by_prefix: got %q, want %q", got, want)
+	}
+}
+
+func TestIsDnsmasq(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		version string
+		stats   bool // whether the stats records are answered
+		want    string
+	}{
+		{"dnsmasq", "dnsmasq-2.90", true, "1"},
+		{"BIND", "9.18.24", false, "0"},
+		{"dnsmasq without version", "", true, "1"},
+	} {
+		addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := collectortest.StatsReply(r, "1")
+			var answers []dns.RR
+			for _, rr := range m.Answer {
+				txt := rr.(*dns.TXT)
+				switch {
+				case txt.Hdr.Name == "version.bind.":
+					if tt.version == "" {
+						continue
+					}
+					txt.Txt = []string{tt.version}
+				case !tt.stats:
+					continue
+				}
+				answers = append(answers, rr)
+			}
+			m.Answer = answers
+			w.WriteMsg(m)
+		})
+		c := New(addr, "../testdata/dnsmasq.leases", Options{Client: &dns.Client{}})
+		metrics := fetchMetrics(t, c)
+		stop()
+		if got := metrics["dnsmasq_is_dnsmasq"]; got != tt.want {
+			t.Errorf("%s: dnsmasq_is_dnsmasq: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSourcePort(t *testing.T) {
+	// Pick a free port, see the race condition note in TestDnsmasqExporter.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourcePort := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	// remotePort is written by the stub's goroutine.
+	var remotePort int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.StoreInt32(&remotePort, int32(w.RemoteAddr().(*net.UDPAddr).Port))
+		w.WriteMsg(collectortest.StatsReply(r, "1"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:     &dns.Client{},
+		SourceIP:   net.ParseIP("127.0.0.1"),
+		SourcePort: sourcePort,
+	})
+	fetchMetrics(t, c)
+	if got, want := int(atomic.LoadInt32(&remotePort)), sourcePort; got != want {
+		t.Errorf("unexpected query source port: got %d, want %d", got, want)
+	}
+}
+
+func TestDNSRTT(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteMsg(collectortest.StatsReply(r, "1"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{Client: &dns.Client{}})
+	ctx := WithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	text, err := gather(ctx, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := collectortest.ParseMetrics(text)
+	rtt, err := strconv.ParseFloat(metrics["dnsmasq_dns_rtt_seconds"], 64)
+	if err != nil {
+		t.Fatalf("dnsmasq_dns_rtt_seconds: %v", err)
+	}
+	if rtt < 0.02 || rtt > 1 {
+		t.Errorf("dnsmasq_dns_rtt_seconds: got %v, want between 0.02 and 1", rtt)
+	}
+
+	var m dto.Metric
+	if err := c.queryDuration.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	var labels map[string]string
+	for _, b := range m.GetHistogram().GetBucket() {
+		if e := b.GetExemplar(); e != nil {
+			labels = make(map[string]string)
+			for _, l := range e.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+		}
+	}
+	want := map[string]string{"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736", "span_id": "00f067aa0ba902b7"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("exemplar labels: got %v, want %v", labels, want)
+	}
+
+	// dnsmasq is not queried with Options.StatsFile.
+	c = New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/dig.txt"})
+	if v, ok := fetchMetrics(t, c)["dnsmasq_dns_rtt_seconds"]; ok {
+		t.Errorf("dnsmasq_dns_rtt_seconds: got %q, want no metric", v)
+	}
+}
+
+func TestResolvePTR(t *testing.T) {
+	// lookups is incremented by the stub's goroutine.
+	var lookups int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype != dns.TypePTR {
+			w.WriteMsg(collectortest.StatsReply(r, "1"))
+			return
+		}
+		atomic.AddInt32(&lookups, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		ptr := map[string]string{
+			"11.1.168.192.in-addr.arpa.": "phone.lan.",
+			"10.1.168.192.in-addr.arpa.": "desktop.lan.",
+		}[r.Question[0].Name]
+		if ptr != "" {
+			m.Answer = append(m.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET},
+				Ptr: ptr,
+			})
+		}
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:     &dns.Client{},
+		ResolvePTR: true,
+		PTRTimeout: 5 * time.Second,
+	})
+	for i := 0; i < 2; i++ {
+		metrics := fetchMetrics(t, c)
+		for _, key := range []string{
+			`dnsmasq_lease_expiry{client_id="",computer_name="phone.lan",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb",ptr="phone.lan"}`,
+			`dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55",ptr="desktop.lan"}`,
+		} {
+			if _, ok := metrics[key]; !ok {
+				t.Errorf("metric %s not found", key)
+			}
+		}
+		// The laptop lease (192.168.1.10) resolves to desktop.lan.
+		if got, want := metrics["dnsmasq_lease_hostname_dns_mismatch"], "1"; got != want {
+			t.Errorf("dnsmasq_lease_hostname_dns_mismatch: got %q, want %q", got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&lookups), int32(2); got != want {
+		t.Errorf("unexpected number of PTR lookups: got %d, want %d (cached)", got, want)
+	}
+}
+
+func TestPTRLabelNXDOMAIN(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype != dns.TypePTR {
+			w.WriteMsg(collectortest.StatsReply(r, "1"))
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:     &dns.Client{},
+		ResolvePTR: true,
+		PTRTimeout: 5 * time.Second,
+	})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_up"], "1"; got != want {
+		t.Errorf("dnsmasq_up: got %q, want %q", got, want)
+	}
+	key := `dnsmasq_lease_expiry{client_id="",computer_name="",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb",ptr=""}`
+	if _, ok := metrics[key]; !ok {
+		t.Errorf("metric %s not found", key)
+	}
+}
+
+func TestLeasesObserved(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/dig.txt"})
+	before := fetchMetrics(t, c)["dnsmasq_leases_observed_total"]
+	after := fetchMetrics(t, c)["dnsmasq_leases_observed_total"]
+	if before != after {
+		t.Errorf("dnsmasq_leases_observed_total changed without new leases: before %q, after %q", before, after)
+	}
+	if got, want := len(c.seen), 2; got != want {
+		t.Errorf("unexpected number of observed leases: got %d, want %d", got, want)
+	}
+}
+
+func TestExtraStats(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := collectortest.StatsReply(r, "42")
+		// Pretend this build does not know about foo.bind.
+		var answers []dns.RR
+		for _, a := range m.Answer {
+			if a.Header().Name != "foo.bind." {
+				answers = append(answers, a)
+			}
+		}
+		m.Answer = answers
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:     &dns.Client{},
+		ExtraStats: []string{"tftp.bind.", "foo.bind."},
+	})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics[`dnsmasq_extra_stat{record="tftp.bind."}`], "42"; got != want {
+		t.Errorf("dnsmasq_extra_stat for tftp.bind: got %q, want %q", got, want)
+	}
+	if got, ok := metrics[`dnsmasq_extra_stat{record="foo.bind."}`]; ok {
+		t.Errorf("dnsmasq_extra_stat for unanswered foo.bind unexpectedly present: %q", got)
+	}
+}
+
+func TestMissingClientID(t *testing.T) {
+	c := New("", "../testdata/missing_client_id.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_leases":                   "2",
+		"dnsmasq_leases_missing_client_id": "1",
+		`dnsmasq_lease_expiry{client_id="",computer_name="printer",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`:                    "4.1024448e+09",
+		`dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`: "4.1024448e+09",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		h := newQueryDuration(native)
+		h.Observe(0.003)
+		var m dto.Metric
+		if err := h.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := m.GetHistogram().Schema != nil, native; got != want {
+			t.Errorf("native = %v: native histogram schema present = %v, want %v", native, got, want)
+		}
+		if got := len(m.GetHistogram().GetBucket()); got == 0 {
+			t.Errorf("native = %v: classic buckets unexpectedly missing", native)
+		}
+	}
+}
+
+func TestClientIDs(t *testing.T) {
+	c := New("", "../testdata/client_ids.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_unique_client_ids":     "2",
+		"dnsmasq_clientid_mac_mismatch": "1",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestQnameCase(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		// Echo the question names, including their case.
+		w.WriteMsg(collectortest.StatsReply(r, "7"))
+	})
+	defer stop()
+
+	for _, qnameCase := range []string{"preserve", "lower", "random"} {
+		t.Run(qnameCase, func(t *testing.T) {
+			c := New(addr, "../testdata/dnsmasq.leases", Options{
+				Client:     &dns.Client{},
+				ExtraStats: []string{"TFTP.bind."},
+				QnameCase:  qnameCase,
+			})
+			metrics := fetchMetrics(t, c)
+			if got, want := metrics["dnsmasq_cachesize"], "7"; got != want {
+				t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+			}
+			if got, want := metrics[`dnsmasq_extra_stat{record="tftp.bind."}`], "7"; got != want {
+				t.Errorf("dnsmasq_extra_stat: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHostnameMatches(t *testing.T) {
+	for _, tt := range []struct {
+		hostname, ptr string
+		want          bool
+	}{
+		{"laptop", "laptop.lan", true},
+		{"Laptop", "laptop", true},
+		{"laptop.lan", "laptop.lan", true},
+		{"laptop.lan", "laptop.example", false},
+		{"laptop", "desktop.lan", false},
+	} {
+		if got := hostnameMatches(tt.hostname, tt.ptr); got != tt.want {
+			t.Errorf("hostnameMatches(%q, %q) = %v, want %v", tt.hostname, tt.ptr, got, tt.want)
+		}
+	}
+}
+
+func TestLeasesByState(t *testing.T) {
+	c := New("", "../testdata/lease_states.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	for _, state := range []string{"active", "expired", "static"} {
+		key := `dnsmasq_leases_by_state{state="` + state + `"}`
+		if got, want := metrics[key], "1"; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLeasesActive(t *testing.T) {
+	for _, tt := range []struct {
+		leasesPath string
+		leases     string
+		active     string
+	}{
+		{"../testdata/dnsmasq.leases", "2", "2"},
+		// The expired lease is counted in dnsmasq_leases only, the static
+		// lease in both.
+		{"../testdata/lease_states.leases", "3", "2"},
+	} {
+		c := New("", tt.leasesPath, Options{StatsFile: "../testdata/dig.txt"})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_leases"], tt.leases; got != want {
+			t.Errorf("%s: dnsmasq_leases: got %q, want %q", tt.leasesPath, got, want)
+		}
+		if got, want := metrics["dnsmasq_leases_active"], tt.active; got != want {
+			t.Errorf("%s: dnsmasq_leases_active: got %q, want %q", tt.leasesPath, got, want)
+		}
+	}
+}
+
+func TestHostnameCollisions(t *testing.T) {
+	for _, tt := range []struct {
+		leasesPath string
+		want       string
+	}{
+		{"../testdata/dnsmasq.leases", "0"},
+		{"../testdata/duplicate.leases", "0"},
+		// android-1234 collides (case-insensitively), the printer's other
+		// leases are of the same MAC or DHCPv6.
+		{"../testdata/hostname_collisions.leases", "1"},
+	} {
+		c := New("", tt.leasesPath, Options{StatsFile: "../testdata/dig.txt"})
+		metrics := fetchMetrics(t, c)
+		if got := metrics["dnsmasq_lease_hostname_collisions"]; got != tt.want {
+			t.Errorf("%s: dnsmasq_lease_hostname_collisions: got %q, want %q", tt.leasesPath, got, tt.want)
+		}
+	}
+}
+
+func TestMaxLeaseSeries(t *testing.T) {
+	for _, tt := range []struct {
+		maxLeaseSeries int
+		truncated      string
+		want           []string // computer_name of the exported leases
+	}{
+		{0, "0", []string{"laptop", "phone", "printer"}},
+		{3, "0", []string{"laptop", "phone", "printer"}},
+		// The infinite lease expires last.
+		{2, "1", []string{"laptop", "phone"}},
+		{1, "2", []string{"phone"}},
+	} {
+		c := New("", "../testdata/lease_states.leases", Options{
+			StatsFile:      "../testdata/dig.txt",
+			MaxLeaseSeries: tt.maxLeaseSeries,
+		})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_leases_truncated"], tt.truncated; got != want {
+			t.Errorf("MaxLeaseSeries=%d: dnsmasq_leases_truncated: got %q, want %q", tt.maxLeaseSeries, got, want)
+		}
+		// Aggregates still count all leases.
+		if got, want := metrics["dnsmasq_leases"], "3"; got != want {
+			t.Errorf("MaxLeaseSeries=%d: dnsmasq_leases: got %q, want %q", tt.maxLeaseSeries, got, want)
+		}
+		var got []string
+		for key := range metrics {
+			if !strings.HasPrefix(key, "dnsmasq_lease_expiry{") {
+				continue
+			}
+			for _, name := range []string{"laptop", "phone", "printer"} {
+				if strings.Contains(key, `computer_name="`+name+`"`) {
+					got = append(got, name)
+				}
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MaxLeaseSeries=%d: exported leases: got %q, want %q", tt.maxLeaseSeries, got, tt.want)
+		}
+	}
+}
+
+func TestScrapeResult(t *testing.T) {
+	// The stub never answers, so that stats queries time out.
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer stop()
+
+	for _, tt := range []struct {
+		name       string
+		statsFile  string
+		leasesPath string
+		want       string
+	}{
+		{"ok", "../testdata/dig.txt", "../testdata/dnsmasq.leases", "ok"},
+		{"dns_failed", "../testdata/nonexistent", "../testdata/dnsmasq.leases", "dns_failed"},
+		// Reading a directory fails like reading an unreadable file.
+		{"leases_failed", "../testdata/dig.txt", "../testdata", "leases_failed"},
+		{"both_failed", "../testdata/nonexistent", "../testdata", "both_failed"},
+		// A missing leases file means zero leases, e.g. with DHCP disabled.
+		{"leases_missing", "../testdata/dig.txt", "../testdata/nonexistent", "ok"},
+		{"timeout", "", "../testdata/dnsmasq.leases", "timeout"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(addr, tt.leasesPath, Options{
+				Client:    &dns.Client{Timeout: 100 * time.Millisecond},
+				StatsFile: tt.statsFile,
+			})
+			metrics := fetchMetrics(t, c)
+			for _, result := range scrapeResults {
+				want := "0"
+				if result == tt.want {
+					want = "1"
+				}
+				key := `dnsmasq_scrape_result{result="` + result + `"}`
+				if got := metrics[key]; got != want {
+					t.Errorf("metric %s: got %q, want %q", key, got, want)
+				}
+			}
+			want := "0"
+			if tt.want == "ok" {
+				want = "1"
+			}
+			if got := metrics["dnsmasq_up"]; got != want {
+				t.Errorf("dnsmasq_up: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDHCPv6Leases(t *testing.T) {
+	c := New("", "../testdata/dual_stack.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases"], "3"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+	for _, key := range []string{
+		`dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`,
+		`dnsmasq_lease_expiry_v6{client_duid="00:01:00:01:2a:bc:de:f0:00:11:22:33:44:55",computer_name="laptop",iaid="1122867",ip_addr="2001:db8::10"}`,
+		`dnsmasq_lease_expiry_v6{client_duid="00:04:5a:26:7b:1c:9e:4f:a2:bb:3d:11:8f:22:01:7e:55:aa",computer_name="",iaid="305419896",ip_addr="2001:db8::11"}`,
+	} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("metric %s not found", key)
+		}
+	}
+}
+
+func TestMalformedLeases(t *testing.T) {
+	c := New("", "../testdata/malformed.leases", Options{StatsFile: "../testdata/dig.txt"})
+	before, _ := strconv.ParseFloat(fetchMetrics(t, c)["dnsmasq_lease_parse_errors_total"], 64)
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases"], "1"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+	after, _ := strconv.ParseFloat(metrics["dnsmasq_lease_parse_errors_total"], 64)
+	if got, want := after-before, 1.0; got != want {
+		t.Errorf("dnsmasq_lease_parse_errors_total increased by %v, want %v", got, want)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/dig.txt"})
+	want := `
+# HELP dnsmasq_cachesize configured size of the DNS cache
+# TYPE dnsmasq_cachesize gauge
+dnsmasq_cachesize 150
+# HELP dnsmasq_leases Number of DHCP leases handed out
+# TYPE dnsmasq_leases gauge
+dnsmasq_leases 2
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "dnsmasq_cachesize", "dnsmasq_leases"); err != nil {
+		t.Error(err)
+	}
+	problems, err := testutil.CollectAndLint(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		switch p.Metric {
+		case "dnsmasq_servers_count":
+			// These metrics predate the library and keep their names.
+			continue
+		}
+		t.Errorf("lint: %s: %s", p.Metric, p.Text)
+	}
+
+	// A failed subsystem leaves out its metrics instead of exporting stale
+	// or zero values.
+	c.SetLeasesPath("../testdata")
+	if got := testutil.CollectAndCount(c, "dnsmasq_leases"); got != 0 {
+		t.Errorf("dnsmasq_leases: got %d series, want 0", got)
+	}
+}
+
+func TestTCPFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		w.WriteMsg(collectortest.StatsReply(r, "9"))
+	})
+	accept := func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: h, MsgAcceptFunc: accept},
+		{Listener: ln, Handler: h, MsgAcceptFunc: accept},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		defer srv.Shutdown()
+	}
+
+	for _, tt := range []struct {
+		net          string
+		wantFallback string
+	}{
+		{"udp", "1"},
+		{"tcp", "0"},
+	} {
+		t.Run(tt.net, func(t *testing.T) {
+			c := New(ln.Addr().String(), "../testdata/dnsmasq.leases", Options{Client: &dns.Client{Net: tt.net}})
+			metrics := fetchMetrics(t, c)
+			if got, want := metrics["dnsmasq_cachesize"], "9"; got != want {
+				t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+			}
+			if got, want := metrics["dnsmasq_dns_tcp_fallback_active"], tt.wantFallback; got != want {
+				t.Errorf("dnsmasq_dns_tcp_fallback_active: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   traceContext
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}, true},
+		// Later versions may append fields.
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", traceContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}, true},
+		{"", traceContext{}, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", traceContext{}, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceContext{}, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", traceContext{}, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", traceContext{}, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", traceContext{}, false},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", traceContext{}, false},
+	} {
+		got, ok := parseTraceparent(tt.header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseTraceparent(%q): got %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRecursionDesired(t *testing.T) {
+	var rd int32 = -1
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.RecursionDesired {
+			atomic.StoreInt32(&rd, 1)
+		} else {
+			atomic.StoreInt32(&rd, 0)
+		}
+		w.WriteMsg(collectortest.StatsReply(r, "1"))
+	})
+	defer stop()
+
+	for _, want := range []bool{true, false} {
+		c := New(addr, "../testdata/dnsmasq.leases", Options{
+			Client:           &dns.Client{Timeout: 1 * time.Second},
+			RecursionDesired: want,
+		})
+		metrics := fetchMetrics(t, c)
+		if got := metrics["dnsmasq_up"]; got != "1" {
+			t.Fatalf("RecursionDesired=%v: dnsmasq_up: got %q, want 1", want, got)
+		}
+		if got := atomic.LoadInt32(&rd) == 1; got != want {
+			t.Errorf("RecursionDesired=%v: RD bit: got %v, want %v", want, got, want)
+		}
+	}
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	// The servers.bind answer of a busy server does not fit into 512 bytes.
+	var servers []string
+	for i := 0; i < 60; i++ {
+		servers = append(servers, fmt.Sprintf("192.0.2.%d#53 %d 0", i, 1000+i))
+	}
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := collectortest.StatsReply(r, "1")
+		for _, rr := range m.Answer {
+			if rr.Header().Name == "servers.bind." {
+				rr.(*dns.TXT).Txt = servers
+			}
+		}
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+			m.SetEdns0(opt.UDPSize(), false)
+		}
+		m.Truncate(size)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	for _, tt := range []struct {
+		udpBufferSize uint16
+		up            string
+	}{
+		{4096, "1"},
+		// The truncated answer is retried over TCP, which the stub does not
+		// listen on.
+		{0, "0"},
+	} {
+		c := New(addr, "../testdata/dnsmasq.leases", Options{
+			Client:        &dns.Client{Timeout: 1 * time.Second},
+			UDPBufferSize: tt.udpBufferSize,
+		})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_up"], tt.up; got != want {
+			t.Errorf("UDPBufferSize=%d: dnsmasq_up: got %q, want %q", tt.udpBufferSize, got, want)
+		}
+		if tt.up != "1" {
+			continue
+		}
+		if got, want := metrics["dnsmasq_dns_tcp_fallback_active"], "0"; got != want {
+			t.Errorf("UDPBufferSize=%d: dnsmasq_dns_tcp_fallback_active: got %q, want %q", tt.udpBufferSize, got, want)
+		}
+		if got, want := metrics["dnsmasq_servers_count"], "60"; got != want {
+			t.Errorf("UDPBufferSize=%d: dnsmasq_servers_count: got %q, want %q", tt.udpBufferSize, got, want)
+		}
+	}
+}
+
+func TestCacheUtilization(t *testing.T) {
+	for _, tt := range []struct {
+		cachesize, insertions string
+		want                  string // "" if not exported
+	}{
+		{"150", "50", strconv.FormatFloat(50.0/150, 'g', -1, 64)},
+		{"150", "4117", "1"},
+		{"0", "0", ""},
+	} {
+		addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := collectortest.StatsReply(r, "0")
+			for _, rr := range m.Answer {
+				switch rr.Header().Name {
+				case "cachesize.bind.":
+					rr.(*dns.TXT).Txt = []string{tt.cachesize}
+				case "insertions.bind.":
+					rr.(*dns.TXT).Txt = []string{tt.insertions}
+				}
+			}
+			w.WriteMsg(m)
+		})
+		c := New(addr, "../testdata/dnsmasq.leases", Options{Client: &dns.Client{}})
+		metrics := fetchMetrics(t, c)
+		stop()
+		if got, want := metrics["dnsmasq_cache_utilization"], tt.want; got != want {
+			t.Errorf("cachesize %s, insertions %s: dnsmasq_cache_utilization: got %q, want %q", tt.cachesize, tt.insertions, got, want)
+		}
+	}
+}
+
+func TestCacheHitRatioWithoutQueries(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(collectortest.StatsReply(r, "0"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{Client: &dns.Client{}})
+	metrics := fetchMetrics(t, c)
+	if got, ok := metrics["dnsmasq_cache_hit_ratio"]; ok {
+		t.Errorf("dnsmasq_cache_hit_ratio: got %q, want no value without queries", got)
+	}
+}
+
+func TestStatsRecords(t *testing.T) {
+	var mu sync.Mutex
+	var names []string // guarded by mu
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		names = names[:0]
+		for _, q := range r.Question {
+			names = append(names, q.Name)
+		}
+		mu.Unlock()
+		w.WriteMsg(collectortest.StatsReply(r, "3"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:       &dns.Client{},
+		StatsRecords: []string{"cachesize.bind.", "hits.bind.", "custom.bind."},
+	})
+	metrics := fetchMetrics(t, c)
+	mu.Lock()
+	if got, want := names, []string{"cachesize.bind.", "hits.bind.", "custom.bind.", "version.bind."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected questions: got %v, want %v", got, want)
+	}
+	mu.Unlock()
+	want := map[string]string{
+		"dnsmasq_cachesize": "3",
+		"dnsmasq_hits":      "3",
+		`dnsmasq_extra_stat{record="custom.bind."}`: "3",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+	for _, name := range []string{"dnsmasq_misses", "dnsmasq_servers_count"} {
+		if got, ok := metrics[name]; ok {
+			t.Errorf("%s: got %q, want no value for an unqueried record", name, got)
+		}
+	}
+}
+
+func TestCacheDuration(t *testing.T) {
+	var mu sync.Mutex
+	var queries int
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond) // let concurrent scrapes overlap
+		w.WriteMsg(collectortest.StatsReply(r, "150"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:        &dns.Client{},
+		CacheDuration: time.Minute,
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := gather(context.Background(), c, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_cachesize"], "150"; got != want {
+		t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := queries, 1; got != want {
+		t.Errorf("unexpected number of stats queries: got %d, want %d", got, want)
+	}
+}
+
+func TestScrapeDuration(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteMsg(collectortest.StatsReply(r, "1"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:        &dns.Client{},
+		CacheDuration: time.Minute,
+	})
+	durations := func() (scrape, total float64) {
+		metrics := fetchMetrics(t, c)
+		scrape, err := strconv.ParseFloat(metrics["dnsmasq_scrape_duration_seconds"], 64)
+		if err != nil {
+			t.Fatalf("dnsmasq_scrape_duration_seconds: %v", err)
+		}
+		total, err = strconv.ParseFloat(metrics[`dnsmasq_scrape_phase_duration_seconds{phase="total"}`], 64)
+		if err != nil {
+			t.Fatalf("dnsmasq_scrape_phase_duration_seconds: %v", err)
+		}
+		return scrape, total
+	}
+	if scrape, total := durations(); scrape < total || scrape < 0.02 {
+		t.Errorf("dnsmasq_scrape_duration_seconds: got %v, want at least the total phase (%v) and 0.02", scrape, total)
+	}
+	// The cached collection is served without waiting for dnsmasq.
+	if scrape, total := durations(); scrape >= total {
+		t.Errorf("dnsmasq_scrape_duration_seconds: got %v for a cached collection, want less than the total phase (%v)", scrape, total)
+	}
+}
+
+func TestCacheCanceled(t *testing.T) {
+	var queries, fail int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		w.WriteMsg(collectortest.StatsReply(r, "150"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:        &dns.Client{Timeout: 5 * time.Second},
+		CacheDuration: time.Minute,
+	})
+	// The first scrape gives up before dnsmasq answers, which must neither
+	// fail the second scrape sharing its collection nor be cached.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan string)
+	go func() {
+		text, err := gather(ctx, c, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		first <- text
+	}()
+	for atomic.LoadInt32(&queries) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_up"], "1"; got != want {
+		t.Errorf("dnsmasq_up of the second scrape: got %q, want %q", got, want)
+	}
+	if body := <-first; !strings.Contains(body, "\ndnsmasq_up 0\n") {
+		t.Errorf("first scrape unexpectedly succeeded:\n%s", body)
+	}
+	metrics = fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_up"], "1"; got != want {
+		t.Errorf("dnsmasq_up of the cached scrape: got %q, want %q", got, want)
+	}
+	if got, want := atomic.LoadInt32(&queries), int32(1); got != want {
+		t.Errorf("unexpected number of stats queries: got %d, want %d", got, want)
+	}
+
+	// Failed collections are not cached, so each scrape retries.
+	c.cache = newScrapeCache(time.Minute)
+	atomic.StoreInt32(&fail, 1)
+	atomic.StoreInt32(&queries, 0)
+	for i := 0; i < 2; i++ {
+		if got, want := fetchMetrics(t, c)["dnsmasq_up"], "0"; got != want {
+			t.Errorf("dnsmasq_up of failing scrape %d: got %q, want %q", i, got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&queries), int32(2); got < want {
+		t.Errorf("unexpected number of stats queries: got %d, want at least %d", got, want)
+	}
+}
+
+func TestSingleInflight(t *testing.T) {
+	var queries int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(100 * time.Millisecond) // let concurrent scrapes overlap
+		w.WriteMsg(collectortest.StatsReply(r, "150"))
+	})
+	defer stop()
+
+	for _, tt := range []struct {
+		singleInflight bool
+		want           int32
+	}{
+		{true, 1},
+		{false, 3},
+	} {
+		atomic.StoreInt32(&queries, 0)
+		c := New(addr, "../testdata/dnsmasq.leases", Options{
+			Client:         &dns.Client{},
+			SingleInflight: tt.singleInflight,
+		})
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				text, err := gather(context.Background(), c, nil)
+				if err != nil {
+					t.Error(err)
+				}
+				if !strings.Contains(text, "\ndnsmasq_cachesize 150\n") {
+					t.Errorf("SingleInflight=%v: dnsmasq_cachesize 150 not found", tt.singleInflight)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := atomic.LoadInt32(&queries); got != tt.want {
+			t.Errorf("SingleInflight=%v: unexpected number of stats queries: got %d, want %d", tt.singleInflight, got, tt.want)
+		}
+	}
+}
+
+func TestSingleInflightCanceled(t *testing.T) {
+	var queries int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteMsg(collectortest.StatsReply(r, "150"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:         &dns.Client{Timeout: 5 * time.Second},
+		SingleInflight: true,
+	})
+	// The first scrape gives up before dnsmasq answers, which must not fail
+	// the second scrape sharing its query.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan string)
+	go func() {
+		text, err := gather(ctx, c, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		first <- text
+	}()
+	for atomic.LoadInt32(&queries) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_up"], "1"; got != want {
+		t.Errorf("dnsmasq_up of the second scrape: got %q, want %q", got, want)
+	}
+	if got, want := metrics["dnsmasq_cachesize"], "150"; got != want {
+		t.Errorf("dnsmasq_cachesize of the second scrape: got %q, want %q", got, want)
+	}
+	if body := <-first; !strings.Contains(body, "\ndnsmasq_up 0\n") {
+		t.Errorf("first scrape unexpectedly succeeded:\n%s", body)
+	}
+	if got, want := atomic.LoadInt32(&queries), int32(1); got != want {
+		t.Errorf("unexpected number of stats queries: got %d, want %d", got, want)
+	}
+}
+
+func TestCollectInterval(t *testing.T) {
+	var queries int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		w.WriteMsg(collectortest.StatsReply(r, "150"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:          &dns.Client{},
+		CollectInterval: time.Hour,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	// Scrapes wait for the first background collection, and are then served
+	// without querying dnsmasq.
+	for i := 0; i < 3; i++ {
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_cachesize"], "150"; got != want {
+			t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&queries), int32(1); got != want {
+		t.Errorf("unexpected number of stats queries: got %d, want %d", got, want)
+	}
+	// Scrapes for other subnets are not collected in the background.
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gather(context.Background(), c, []*net.IPNet{subnet}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&queries), int32(2); got != want {
+		t.Errorf("unexpected number of stats queries: got %d, want %d", got, want)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background collection not stopped")
+	}
+}
+
+func TestHideLeases(t *testing.T) {
+	c := New("", "../testdata/dual_stack.leases", Options{
+		StatsFile:  "../testdata/dig.txt",
+		HideLeases: true,
+	})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases"], "3"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry") {
+			t.Errorf("per-lease metric %q unexpectedly present", key)
+		}
+	}
+}
+
+func TestUnknownHostname(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	// The second lease has "*" as hostname and client identifier.
+	key := `dnsmasq_lease_expiry{client_id="",computer_name="",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`
+	if got, want := metrics[key], "4.1024448e+09"; got != want {
+		t.Errorf("%s: got %q, want %q", key, got, want)
+	}
+	for key := range metrics {
+		if strings.Contains(key, `="*"`) {
+			t.Errorf("unexpected * label value: %s", key)
+		}
+	}
+}
+
+func TestDuplicateLeases(t *testing.T) {
+	c := New("", "../testdata/duplicate.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	var series int
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry{") {
+			series++
+		}
+	}
+	if got, want := series, 1; got != want {
+		t.Errorf("dnsmasq_lease_expiry: got %d series, want %d", got, want)
+	}
+	// The record with the latest expiry wins, regardless of its position.
+	key := `dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`
+	if got, want := metrics[key], "4.1024448e+09"; got != want {
+		t.Errorf("%s: got %q, want %q", key, got, want)
+	}
+}
+
+func TestOutlives(t *testing.T) {
+	for _, tt := range []struct {
+		a, b int64
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0, 1, true},
+		{1, 0, false},
+		{0, 0, false},
+	} {
+		if got := outlives(tt.a, tt.b); got != tt.want {
+			t.Errorf("outlives(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	c := New("", "../testdata/lease_states.leases", Options{StatsFile: "../testdata/dig.txt"})
+	start := time.Now()
+	metrics := fetchMetrics(t, c)
+	ttl := func(labels string) float64 {
+		v, err := strconv.ParseFloat(metrics["dnsmasq_lease_ttl_seconds"+labels], 64)
+		if err != nil {
+			t.Fatalf("dnsmasq_lease_ttl_seconds%s: %v", labels, err)
+		}
+		return v
+	}
+	active := ttl(`{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`)
+	if want := time.Unix(4102444800, 0).Sub(start).Seconds(); active > want || active < want-60 {
+		t.Errorf("active lease: got TTL %v, want approximately %v", active, want)
+	}
+	if expired := ttl(`{client_id="",computer_name="phone",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`); expired >= 0 {
+		t.Errorf("expired lease: got TTL %v, want < 0", expired)
+	}
+	static := `dnsmasq_lease_ttl_seconds{client_id="",computer_name="printer",ip_addr="192.168.1.12",mac_addr="aa:bb:cc:dd:ee:ff"}`
+	if got, ok := metrics[static]; ok {
+		t.Errorf("%s unexpectedly present for infinite lease: %q", static, got)
+	}
+}
+
+func TestMissingLeasesFile(t *testing.T) {
+	for _, tt := range []struct {
+		leasesPath string
+		present    string
+	}{
+		{"../testdata/dnsmasq.leases", "1"},
+		{"../testdata/nonexistent", "0"},
+	} {
+		c := New("", tt.leasesPath, Options{StatsFile: "../testdata/dig.txt"})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_leases_file_present"], tt.present; got != want {
+			t.Errorf("%s: dnsmasq_leases_file_present: got %q, want %q", tt.leasesPath, got, want)
+		}
+		if tt.present == "0" {
+			if got, want := metrics["dnsmasq_leases"], "0"; got != want {
+				t.Errorf("%s: dnsmasq_leases: got %q, want %q", tt.leasesPath, got, want)
+			}
+		}
+		// DNS stats are exported regardless of the leases file.
+		if got, want := metrics["dnsmasq_cachesize"], "150"; got != want {
+			t.Errorf("%s: dnsmasq_cachesize: got %q, want %q", tt.leasesPath, got, want)
+		}
+	}
+}
+
+func TestReadOUIs(t *testing.T) {
+	ouis, err := ReadOUIs("../testdata/oui.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"001122": "CIMSYS Inc",
+		"aabbcc": "Example Devices",
+	}
+	if !reflect.DeepEqual(ouis, want) {
+		t.Errorf("ReadOUIs: got %v, want %v", ouis, want)
+	}
+	for mac, want := range map[string]string{
+		"00:11:22:33:44:55": "CIMSYS Inc",
+		"AA-BB-CC-00-00-01": "Example Devices",
+		"66:77:88:99:aa:bb": "unknown",
+	} {
+		if got := vendor(ouis, mac); got != want {
+			t.Errorf("vendor(%q) = %q, want %q", mac, got, want)
+		}
+	}
+}
+
+func TestVendorLabel(t *testing.T) {
+	ouis, err := ReadOUIs("../testdata/oui.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New("", "../testdata/dnsmasq.leases", Options{
+		StatsFile: "../testdata/dig.txt",
+		OUIs:      ouis,
+	})
+	m := newScrapeMetrics(nil, true, false, false)
+	if _, leasesErr := c.collect(context.Background(), m, c.DefaultTarget(), nil); leasesErr != nil {
+		t.Fatal(leasesErr)
+	}
+	if got, want := testutil.CollectAndCount(m.leaseExpiry), 2; got != want {
+		t.Errorf("dnsmasq_lease_expiry: got %d series, want %d", got, want)
+	}
+	if got, want := testutil.CollectAndCount(m.leaseTTL), 2; got != want {
+		t.Errorf("dnsmasq_lease_ttl_seconds: got %d series, want %d", got, want)
+	}
+	for _, labels := range [][]string{
+		{"00:11:22:33:44:55", "192.168.1.10", "laptop", "01:00:11:22:33:44:55", "CIMSYS Inc"},
+		{"66:77:88:99:aa:bb", "192.168.1.11", "", "", "unknown"},
+	} {
+		if got, want := testutil.ToFloat64(m.leaseExpiry.WithLabelValues(labels...)), 4102444800.0; got != want {
+			t.Errorf("dnsmasq_lease_expiry%q: got %v, want %v", labels, got, want)
+		}
+		// The TTL series carry the same labels, including vendor.
+		if got := testutil.ToFloat64(m.leaseTTL.WithLabelValues(labels...)); got <= 0 {
+			t.Errorf("dnsmasq_lease_ttl_seconds%q: got %v, want > 0", labels, got)
+		}
+	}
+}
+
+func TestMultipleLeasesFiles(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases,../testdata/client_id*.leases,../testdata/nonexistent", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_leases{file="../testdata/dnsmasq.leases"}`:                 "2",
+		`dnsmasq_leases{file="../testdata/client_ids.leases"}`:              "3",
+		`dnsmasq_leases{file="../testdata/nonexistent"}`:                    "0",
+		`dnsmasq_leases_file_present{file="../testdata/nonexistent"}`:       "0",
+		`dnsmasq_leases_file_present{file="../testdata/client_ids.leases"}`: "1",
+		`dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",file="../testdata/dnsmasq.leases",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`: "4.1024448e+09",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("metric %s: got %q, want %q", key, got, val)
+		}
+	}
+
+	// A single leases file is exported without file label.
+	c.SetLeasesPath("../testdata/dnsmasq.leases")
+	metrics = fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases"], "2"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+}
+
+func TestLastScrapeSuccess(t *testing.T) {
+	c := New("", "../testdata", Options{StatsFile: "../testdata/dig.txt"})
+	const key = "dnsmasq_last_scrape_success_timestamp_seconds"
+	if got, ok := fetchMetrics(t, c)[key]; ok {
+		t.Errorf("%s unexpectedly present before the first successful scrape: %q", key, got)
+	}
+
+	start := time.Now()
+	c.SetLeasesPath("../testdata/dnsmasq.leases")
+	last, err := strconv.ParseFloat(fetchMetrics(t, c)[key], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last < float64(start.Unix()) {
+		t.Errorf("%s: got %v, want >= %v", key, last, start.Unix())
+	}
+
+	// A failed scrape retains the time of the last successful one.
+	c.statsFile = "../testdata/nonexistent"
+	if got, want := fetchMetrics(t, c)[key], strconv.FormatFloat(last, 'g', -1, 64); got != want {
+		t.Errorf("%s after failed scrape: got %q, want %q", key, got, want)
+	}
+}
+
+func TestDNSRetries(t *testing.T) {
+	// The stub drops the first query, like a lost UDP packet.
+	var queries int32
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.AddInt32(&queries, 1) == 1 {
+			return
+		}
+		w.WriteMsg(collectortest.StatsReply(r, "7"))
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{
+		Client:     &dns.Client{Timeout: 100 * time.Millisecond},
+		DNSRetries: 2,
+	})
+	before := testutil.ToFloat64(c.dnsRetriesTotal)
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_cachesize"], "7"; got != want {
+		t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+	}
+	if got, want := testutil.ToFloat64(c.dnsRetriesTotal)-before, 1.0; got != want {
+		t.Errorf("dnsmasq_dns_retries_total: increased by %v, want %v", got, want)
+	}
+
+	// Error responses are not retried.
+	refusedAddr, stopRefused := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	})
+	defer stopRefused()
+	c.dnsmasqAddr = refusedAddr
+	before = testutil.ToFloat64(c.dnsRetriesTotal)
+	fetchMetrics(t, c)
+	if got := testutil.ToFloat64(c.dnsRetriesTotal) - before; got != 0 {
+		t.Errorf("dnsmasq_dns_retries_total: increased by %v for REFUSED, want 0", got)
+	}
+}
+
+func TestRcode(t *testing.T) {
+	for _, tt := range []struct {
+		rcode int
+		up    string
+	}{
+		{dns.RcodeSuccess, "1"},
+		{dns.RcodeRefused, "0"},
+		{dns.RcodeServerFailure, "0"},
+	} {
+		rcode := dns.RcodeToString[tt.rcode]
+		addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := collectortest.StatsReply(r, "1")
+			if tt.rcode != dns.RcodeSuccess {
+				m = new(dns.Msg)
+				m.SetRcode(r, tt.rcode)
+			}
+			w.WriteMsg(m)
+		})
+		c := New(addr, "../testdata/dnsmasq.leases", Options{Client: &dns.Client{}})
+		metrics := fetchMetrics(t, c)
+		stop()
+		if got, want := metrics["dnsmasq_up"], tt.up; got != want {
+			t.Errorf("%s: dnsmasq_up: got %q, want %q", rcode, got, want)
+		}
+		key := `dnsmasq_dns_rcode{rcode="` + rcode + `"}`
+		if got, want := metrics[key], "1"; got != want {
+			t.Errorf("%s: %s: got %q, want %q", rcode, key, got, want)
+		}
+		if tt.up == "1" {
+			continue
+		}
+		if got, want := metrics[`dnsmasq_scrape_error{reason="dns_rcode"}`], "1"; got != want {
+			t.Errorf("%s: dnsmasq_scrape_error{reason=\"dns_rcode\"}: got %q, want %q", rcode, got, want)
+		}
+		if _, ok := metrics["dnsmasq_cachesize"]; ok {
+			t.Errorf("%s: dnsmasq_cachesize unexpectedly exported", rcode)
+		}
+	}
+}
+
+func TestSplitQuestions(t *testing.T) {
+	// The stub only answers the first question of each message, like some
+	// intermediate resolvers.
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := collectortest.StatsReply(r, "7")
+		m.Answer = m.Answer[:1]
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	for _, split := range []bool{false, true} {
+		c := New(addr, "../testdata/dnsmasq.leases", Options{
+			Client:         &dns.Client{},
+			SplitQuestions: split,
+		})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_cachesize"], "7"; got != want {
+			t.Errorf("split=%v: dnsmasq_cachesize: got %q, want %q", split, got, want)
+		}
+		// Without splitting, only the first question is answered.
+		want := "0"
+		if split {
+			want = "7"
+		}
+		if got := metrics["dnsmasq_hits"]; got != want {
+			t.Errorf("split=%v: dnsmasq_hits: got %q, want %q", split, got, want)
+		}
+	}
+}
+
+func TestStrictExpiry(t *testing.T) {
+	const phone = `dnsmasq_lease_expiry{client_id="",computer_name="phone",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`
+	for _, tt := range []struct {
+		strict     bool
+		leases     string
+		expiry     string // of phone, "" if not exported
+		parseError float64
+	}{
+		{false, "2", "-1", 0},
+		{true, "1", "", 1},
+	} {
+		c := New("", "../testdata/invalid_expiry.leases", Options{
+			StatsFile:    "../testdata/dig.txt",
+			StrictExpiry: tt.strict,
+		})
+		before := testutil.ToFloat64(c.leaseParseErrors)
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_leases"], tt.leases; got != want {
+			t.Errorf("StrictExpiry=%v: dnsmasq_leases: got %q, want %q", tt.strict, got, want)
+		}
+		if got, want := metrics[phone], tt.expiry; got != want {
+			t.Errorf("StrictExpiry=%v: %s: got %q, want %q", tt.strict, phone, got, want)
+		}
+		if got, want := testutil.ToFloat64(c.leaseParseErrors)-before, tt.parseError; got != want {
+			t.Errorf("StrictExpiry=%v: dnsmasq_lease_parse_errors_total: increased by %v, want %v", tt.strict, got, want)
+		}
+	}
+}
+
+func TestInvalidLeaseFields(t *testing.T) {
+	c := New("", "../testdata/invalid_fields.leases", Options{StatsFile: "../testdata/dig.txt"})
+	before := testutil.ToFloat64(c.leaseParseErrors)
+	metrics := fetchMetrics(t, c)
+	// The leases with an invalid MAC (zz:…) and IP (192.168.1.999) are
+	// skipped, the InfiniBand lease with hardware type prefix is valid.
+	if got, want := metrics["dnsmasq_leases"], "2"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+	if got, want := testutil.ToFloat64(c.leaseParseErrors)-before, 2.0; got != want {
+		t.Errorf("dnsmasq_lease_parse_errors_total: increased by %v, want %v", got, want)
+	}
+	for key := range metrics {
+		if strings.Contains(key, "zz:11") || strings.Contains(key, "192.168.1.999") {
+			t.Errorf("unexpected series for invalid lease: %s", key)
+		}
+	}
+}
+
+func TestValidMAC(t *testing.T) {
+	for _, tt := range []struct {
+		mac  string
+		want bool
+	}{
+		{"00:11:22:33:44:55", true},
+		{"AA:BB:CC:DD:EE:FF", true},
+		{"20-00:11:22:33", true},
+		{"zz:11:22:33:44:55", false},
+		{"00:11::33", false},
+		{"123-00:11", false},
+		{"-00:11", false},
+		{"", false},
+	} {
+		if got := validMAC(tt.mac); got != tt.want {
+			t.Errorf("validMAC(%q) = %v, want %v", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestDHCPRanges(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{
+		StatsFile: "../testdata/dig.txt",
+		ConfFile:  "../testdata/dnsmasq.conf",
+		ConfDir:   "../testdata/dnsmasq.d",
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_dhcp_range_size{range="192.168.1.10-192.168.1.19",tag="lan"}`:   "10",
+		`dnsmasq_dhcp_range_used{range="192.168.1.10-192.168.1.19",tag="lan"}`:   "2",
+		`dnsmasq_dhcp_range_size{range="192.168.2.100-192.168.2.199",tag=""}`:    "100",
+		`dnsmasq_dhcp_range_used{range="192.168.2.100-192.168.2.199",tag=""}`:    "0",
+		`dnsmasq_dhcp_range_size{range="192.168.1.11-192.168.1.11",tag="guest"}`: "1",
+		`dnsmasq_dhcp_range_used{range="192.168.1.11-192.168.1.11",tag="guest"}`: "1",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+	// Commented lines and backup files are skipped.
+	for key := range metrics {
+		if strings.Contains(key, `range="10.`) {
+			t.Errorf("unexpected metric %q", key)
+		}
+	}
+}
+
+func TestParseDHCPRange(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string // tag and range, or "" if skipped
+	}{
+		{"192.168.0.50,192.168.0.150,12h", " 192.168.0.50-192.168.0.150"},
+		{"set:red,192.168.0.50,192.168.0.150", "red 192.168.0.50-192.168.0.150"},
+		{"tag:green,set:red,192.168.0.50,192.168.0.150", "red 192.168.0.50-192.168.0.150"},
+		{"red,192.168.0.150,192.168.0.50,255.255.255.0", "red 192.168.0.50-192.168.0.150"},
+		{"192.168.0.0,static", ""},
+		{"192.168.0.0,proxy", ""},
+		{"1234::2,1234::500,64,12h", ""},
+		{"set:red", ""},
+	} {
+		r, ok := parseDHCPRange(tt.value)
+		got := ""
+		if ok {
+			got = r.tag + " " + r.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseDHCPRange(%q): got %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRemovedLease(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	b, err := ioutil.ReadFile("../testdata/dnsmasq.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Name(), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New("", f.Name(), Options{StatsFile: "../testdata/dig.txt"})
+	laptop := `dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`
+	phone := `dnsmasq_lease_expiry{client_id="",computer_name="",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`
+	metrics := fetchMetrics(t, c)
+	for _, key := range []string{laptop, phone} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("metric %s not found", key)
+		}
+	}
+
+	// The phone lease is released.
+	lines := strings.SplitAfter(string(b), "\n")
+	if err := ioutil.WriteFile(f.Name(), []byte(lines[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after := fetchMetrics(t, c)
+	if got, want := after[laptop], metrics[laptop]; got != want {
+		t.Errorf("metric %s: got %q, want %q (unchanged)", laptop, got, want)
+	}
+	if _, ok := after[phone]; ok {
+		t.Errorf("stale metric %s of removed lease still present", phone)
+	}
+	if got, want := after["dnsmasq_leases"], "1"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	for _, tt := range []struct {
+		hostname, domain string
+		want             string
+	}{
+		{"laptop", "", "laptop"},
+		{"laptop.", "", "laptop"},
+		{"laptop.lan", "", "laptop.lan"},
+		{"laptop", "lan", "laptop"},
+		{"laptop.lan", "lan", "laptop"},
+		{"laptop.LAN.", ".lan.", "laptop"},
+		{"laptop.home.lan", "home.lan", "laptop"},
+		{"laptop.wlan", "lan", "laptop.wlan"},
+		{"lan", "lan", "lan"},
+		{"", "lan", ""},
+	} {
+		if got := normalizeHostname(tt.hostname, tt.domain); got != tt.want {
+			t.Errorf("normalizeHostname(%q, %q): got %q, want %q", tt.hostname, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestStripDomain(t *testing.T) {
+	c := New("", "../testdata/domain.leases", Options{
+		StatsFile:   "../testdata/dig.txt",
+		StripDomain: "lan",
+	})
+	metrics := fetchMetrics(t, c)
+	for _, key := range []string{
+		`dnsmasq_lease_expiry{client_id="01:00:11:22:33:44:55",computer_name="laptop",ip_addr="192.168.1.10",mac_addr="00:11:22:33:44:55"}`,
+		`dnsmasq_lease_expiry{client_id="",computer_name="phone",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`,
+		`dnsmasq_lease_expiry{client_id="",computer_name="tv",ip_addr="192.168.1.12",mac_addr="66:77:88:99:aa:cc"}`,
+	} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("metric %s not found", key)
+		}
+	}
+}
+
+func TestLeaseLabels(t *testing.T) {
+	c := New("", "../testdata/dnsmasq.leases", Options{
+		StatsFile:   "../testdata/dig.txt",
+		LeaseLabels: []string{"ip_addr", "computer_name"},
+	})
+	metrics := fetchMetrics(t, c)
+	for _, key := range []string{
+		`dnsmasq_lease_expiry{computer_name="laptop",ip_addr="192.168.1.10"}`,
+		`dnsmasq_lease_expiry{computer_name="",ip_addr="192.168.1.11"}`,
+	} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("metric %s not found", key)
+		}
+	}
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry{") && (strings.Contains(key, "mac_addr=") || strings.Contains(key, "client_id=")) {
+			t.Errorf("unexpected metric %s", key)
+		}
+	}
+}
+
+func TestLeaseLabelsAllMetrics(t *testing.T) {
+	c := New("", "../testdata/lease_states.leases", Options{
+		StatsFile:   "../testdata/dig.txt",
+		LeaseTime:   12 * time.Hour,
+		LeaseLabels: []string{"ip_addr"},
+	})
+	metrics := fetchMetrics(t, c)
+	for _, key := range []string{
+		`dnsmasq_lease_expiry{ip_addr="192.168.1.10"}`,
+		`dnsmasq_lease_ttl_seconds{ip_addr="192.168.1.10"}`,
+		`dnsmasq_lease_age_seconds{ip_addr="192.168.1.10"}`,
+	} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("metric %s not found", key)
+		}
+	}
+	for key := range metrics {
+		if strings.Contains(key, "mac_addr=") {
+			t.Errorf("unexpected mac_addr label: %s", key)
+		}
+	}
+}
+
+func TestMaxLeasesBytes(t *testing.T) {
+	for _, tt := range []struct {
+		maxBytes int64
+		up       string
+	}{
+		{0, "1"},
+		{116, "1"}, // the size of testdata/dnsmasq.leases
+		{115, "0"},
+	} {
+		c := New("", "../testdata/dnsmasq.leases", Options{
+			StatsFile:      "../testdata/dig.txt",
+			MaxLeasesBytes: tt.maxBytes,
+		})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_up"], tt.up; got != want {
+			t.Errorf("MaxLeasesBytes=%d: dnsmasq_up: got %q, want %q", tt.maxBytes, got, want)
+		}
+	}
+}
+
+func TestParseLeasesColumns(t *testing.T) {
+	b, err := ioutil.ReadFile("../testdata/columns.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases, malformed, err := parseLeases(context.Background(), b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Lease{
+		// Tab-separated.
+		{Expiry: 4102444800, MAC: "00:11:22:33:44:55", IP: "192.168.1.10", Hostname: "laptop", ClientID: "01:00:11:22:33:44:55"},
+		// Missing hostname, the client identifier is in its column.
+		{Expiry: 4102444800, MAC: "66:77:88:99:aa:bb", IP: "192.168.1.11", Hostname: "", ClientID: "01:66:77:88:99:aa:bb"},
+		// Multiple spaces.
+		{Expiry: 4102444800, MAC: "66:77:88:99:aa:cc", IP: "192.168.1.12", Hostname: "tv"},
+		// Missing client identifier column.
+		{Expiry: 4102444800, MAC: "66:77:88:99:aa:ee", IP: "192.168.1.14", Hostname: "printer", missingClientID: true},
+	}
+	if !reflect.DeepEqual(leases, want) {
+		t.Errorf("parseLeases: got %+v, want %+v", leases, want)
+	}
+	// The record with an extra column is malformed.
+	if got, want := malformed, 1; got != want {
+		t.Errorf("parseLeases: got %d malformed lines, want %d", got, want)
+	}
+}
+
+func TestParseLeasesCanceled(t *testing.T) {
+	line := "4102444800 00:11:22:33:44:55 192.168.1.10 laptop *\n"
+	b := []byte(strings.Repeat(line, leasesCheckInterval))
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, _, err := parseLeases(ctx, b, false); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, _, err := parseLeases(ctx, b, false); err != context.Canceled {
+		t.Errorf("parseLeases with canceled context: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLeasesFileMtime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsmasq.leases")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1700000000, 500000000)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	c := New("", path, Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	got, err := strconv.ParseFloat(metrics["dnsmasq_leases_file_mtime_seconds"], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1700000000.5; got != want {
+		t.Errorf("dnsmasq_leases_file_mtime_seconds: got %v, want %v", got, want)
+	}
+
+	c.SetLeasesPath(filepath.Join(dir, "nonexistent"))
+	metrics = fetchMetrics(t, c)
+	if got, ok := metrics["dnsmasq_leases_file_mtime_seconds"]; ok {
+		t.Errorf("dnsmasq_leases_file_mtime_seconds: got %q for a missing file, want no value", got)
+	}
+}
+
+func TestLeasesFileBytes(t *testing.T) {
+	fi, err := os.Stat("../testdata/columns.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New("", "../testdata/columns.leases", Options{StatsFile: "../testdata/dig.txt"})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases_file_bytes"], strconv.FormatInt(fi.Size(), 10); got != want {
+		t.Errorf("dnsmasq_leases_file_bytes: got %q, want %q", got, want)
+	}
+	// One of the 5 records has too many columns.
+	if got, want := metrics["dnsmasq_leases_parsed_records"], "4"; got != want {
+		t.Errorf("dnsmasq_leases_parsed_records: got %q, want %q", got, want)
+	}
+
+	c.SetLeasesPath("../testdata/nonexistent.leases")
+	metrics = fetchMetrics(t, c)
+	for _, name := range []string{"dnsmasq_leases_file_bytes", "dnsmasq_leases_parsed_records"} {
+		if got, want := metrics[name], "0"; got != want {
+			t.Errorf("%s for a missing file: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestScrapeError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	malformed := filepath.Join(dir, "dig.txt")
+	if err := ioutil.WriteFile(malformed, []byte("cachesize.bind. 0 CH TXT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		c      *Collector
+		reason string // or "" for a successful scrape
+	}{
+		{New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/dig.txt"}), ""},
+		{New("", "../testdata/dnsmasq.leases", Options{StatsFile: malformed}), "dns_parse"},
+		{New("", "../testdata/dnsmasq.leases", Options{StatsFile: "../testdata/nonexistent"}), "dns_error"},
+		{New("", "../testdata", Options{StatsFile: "../testdata/dig.txt"}), "leases_read"},
+		{New("", "../testdata/dnsmasq.leases", Options{
+			StatsFile:     "../testdata/dig.txt",
+			KnownMACsFile: "../testdata/nonexistent",
+		}), "leases_open"},
+		// Only the DNS reason is exported if both fail.
+		{New("", "../testdata", Options{StatsFile: malformed}), "dns_parse"},
+	} {
+		var reasons []string
+		for key, val := range fetchMetrics(t, tt.c) {
+			if strings.HasPrefix(key, "dnsmasq_scrape_error{") {
+				if val != "1" {
+					t.Errorf("%s: got %q, want 1", key, val)
+				}
+				reasons = append(reasons, key)
+			}
+		}
+		var want []string
+		if tt.reason != "" {
+			want = []string{`dnsmasq_scrape_error{reason="` + tt.reason + `"}`}
+		}
+		if !reflect.DeepEqual(reasons, want) {
+			t.Errorf("stats %s, leases %s: got %v, want %v", tt.c.statsFile, tt.c.LeasesPath(), reasons, want)
+		}
+	}
+
+	if got, want := errorReason(context.DeadlineExceeded, nil), "dns_timeout"; got != want {
+		t.Errorf("errorReason(%v, nil): got %q, want %q", context.DeadlineExceeded, got, want)
+	}
+	if got, want := errorReason(nil, context.Canceled), "leases_timeout"; got != want {
+		t.Errorf("errorReason(nil, %v): got %q, want %q", context.Canceled, got, want)
+	}
+}
+
+func TestMultiStringTXT(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := collectortest.StatsReply(r, "1")
+		for _, a := range m.Answer {
+			if txt := a.(*dns.TXT); txt.Hdr.Name == "cachesize.bind." {
+				txt.Txt = []string{"15", "0"}
+			}
+		}
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	c := New(addr, "../testdata/dnsmasq.leases", Options{Client: &dns.Client{}})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_up"], "1"; got != want {
+		t.Errorf("dnsmasq_up: got %q, want %q", got, want)
+	}
+	if got, want := metrics["dnsmasq_cachesize"], "150"; got != want {
+		t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+	}
+}
+
+func TestLeasesByPrefixV6(t *testing.T) {
+	for _, tt := range []struct {
+		prefixLen, prefixLenV6 int
+		want                   map[string]string
+	}{
+		{24, 64, map[string]string{
+			`dnsmasq_leases_by_prefix{prefix="192.168.1.0/24"}`:    "2",
+			`dnsmasq_leases_by_prefix{prefix="192.168.2.0/24"}`:    "1",
+			`dnsmasq_leases_by_prefix{prefix="2001:db8:0:1::/64"}`: "1",
+		}},
+		{16, 0, map[string]string{
+			`dnsmasq_leases_by_prefix{prefix="192.168.0.0/16"}`: "3",
+		}},
+		{0, 48, map[string]string{
+			`dnsmasq_leases_by_prefix{prefix="2001:db8::/48"}`: "1",
+		}},
+		{0, 0, map[string]string{}},
+	} {
+		c := New("", "../testdata/subnets.leases", Options{
+			StatsFile:        "../testdata/dig.txt",
+			LeasePrefixLen:   tt.prefixLen,
+			LeasePrefixLenV6: tt.prefixLenV6,
+		})
+		got := make(map[string]string)
+		for key, val := range fetchMetrics(t, c) {
+			if strings.HasPrefix(key, "dnsmasq_leases_by_prefix") {
+				got[key] = val
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LeasePrefixLen=%d LeasePrefixLenV6=%d: got %v, want %v", tt.prefixLen, tt.prefixLenV6, got, tt.want)
+		}
+	}
+}
+
+// trackingListener records the connections it accepted.
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *trackingListener) accepted() []net.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]net.Conn(nil), l.conns...)
+}
+
+func TestReuseConn(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &trackingListener{Listener: inner}
+	srv := &dns.Server{
+		Listener: ln,
+		Net:      "tcp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(collectortest.StatsReply(r, "1"))
+		}),
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	c := New(ln.Addr().String(), "../testdata/dnsmasq.leases", Options{
+		Client:    &dns.Client{Net: "tcp", Timeout: 5 * time.Second},
+		ReuseConn: true,
+	})
+	for i := 0; i < 3; i++ {
+		if got, want := fetchMetrics(t, c)["dnsmasq_up"], "1"; got != want {
+			t.Fatalf("dnsmasq_up: got %q, want %q", got, want)
+		}
+	}
+	if got, want := len(ln.accepted()), 1; got != want {
+		t.Errorf("unexpected number of connections: got %d, want %d", got, want)
+	}
+
+	// dnsmasq closing the connection (e.g. when idle) causes a reconnect
+	// rather than a failed scrape.
+	for _, conn := range ln.accepted() {
+		conn.Close()
+	}
+	before := testutil.ToFloat64(c.dnsReconnects)
+	if got, want := fetchMetrics(t, c)["dnsmasq_up"], "1"; got != want {
+		t.Errorf("dnsmasq_up after the connection was closed: got %q, want %q", got, want)
+	}
+	if got, want := len(ln.accepted()), 2; got != want {
+		t.Errorf("unexpected number of connections: got %d, want %d", got, want)
+	}
+	if got, want := testutil.ToFloat64(c.dnsReconnects)-before, 1.0; got != want {
+		t.Errorf("dnsmasq_dns_reconnects_total increased by %v, want %v", got, want)
+	}
+}
+
+func TestDNSConnEviction(t *testing.T) {
+	c := New("", "", Options{})
+	first := c.dnsConn("192.0.2.0:53")
+	for i := 1; i <= maxDNSConns; i++ {
+		c.dnsConn(fmt.Sprintf("192.0.2.%d:53", i))
+	}
+	// The least recently used connection makes room for the last one.
+	if got, want := len(c.dnsConns), maxDNSConns; got != want {
+		t.Errorf("unexpected number of connections: got %d, want %d", got, want)
+	}
+	if _, ok := c.dnsConns["192.0.2.0:53"]; ok {
+		t.Errorf("least recently used connection not evicted")
+	}
+	evicted := func(conn *dnsConn) bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.evicted
+	}
+	for deadline := time.Now().Add(5 * time.Second); !evicted(first); {
+		if time.Now().After(deadline) {
+			t.Fatal("evicted connection not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Idle connections are evicted when adding a new one.
+	c.dnsConnsMu.Lock()
+	for _, conn := range c.dnsConns {
+		conn.lastUsed = conn.lastUsed.Add(-2 * dnsConnIdleTimeout)
+	}
+	c.dnsConnsMu.Unlock()
+	c.dnsConn("192.0.2.200:53")
+	if got, want := len(c.dnsConns), 1; got != want {
+		t.Errorf("unexpected number of connections after idling: got %d, want %d", got, want)
+	}
+}
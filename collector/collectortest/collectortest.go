@@ -0,0 +1,80 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collectortest provides a stub dnsmasq and helpers for tests of the
+// collector package and of programs built on it.
+package collectortest
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// StartStub starts a DNS server on a random localhost UDP port which answers
+// all queries using h.
+func StartStub(t testing.TB, h dns.HandlerFunc) (addr string, stop func()) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    h,
+		// dnsmasq answers queries with multiple questions.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+// StatsReply answers each CHAOS question of r with a TXT record containing
+// value.
+func StatsReply(r *dns.Msg, value string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, q := range r.Question {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{value},
+		})
+	}
+	return m
+}
+
+// ParseMetrics returns the values of the dnsmasq_* samples in text, which is
+// in the text exposition format, keyed by metric name and labels.
+func ParseMetrics(text string) map[string]string {
+	metrics := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, " ")
+		if len(parts) < 2 {
+			continue
+		}
+		if !strings.HasPrefix(parts[0], "dnsmasq_") {
+			continue
+		}
+		metrics[parts[0]] = parts[1]
+	}
+	return metrics
+}
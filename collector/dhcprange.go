@@ -0,0 +1,180 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dhcpRange is an IPv4 address range from which dnsmasq hands out dynamic
+// leases, see the dhcp-range option in dnsmasq(8).
+type dhcpRange struct {
+	// tag is the tag set by the range (set:<tag>), or "".
+	tag        string
+	start, end uint32
+}
+
+func (r dhcpRange) String() string {
+	return ipv4(r.start).String() + "-" + ipv4(r.end).String()
+}
+
+func (r dhcpRange) size() float64 {
+	return float64(r.end-r.start) + 1
+}
+
+func (r dhcpRange) contains(ip uint32) bool {
+	return r.start <= ip && ip <= r.end
+}
+
+func ipv4(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// parseIPv4 returns s as a number, or false if s is not an IPv4 address.
+func parseIPv4(s string) (uint32, bool) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+// parseDHCPRange parses the value of a dhcp-range option:
+//
+//	[tag:<tag>,[set:<tag>,]]<start-addr>,<end-addr>[,<mode>][,<netmask>[,<broadcast>]][,<lease time>]
+//
+// It returns false for ranges without dynamic IPv4 leases, i.e. IPv6, static
+// and proxy ranges.
+func parseDHCPRange(value string) (dhcpRange, bool) {
+	var r dhcpRange
+	fields := strings.Split(value, ",")
+	for len(fields) > 0 {
+		f := strings.TrimSpace(fields[0])
+		if net.ParseIP(f) != nil {
+			break
+		}
+		switch {
+		case strings.HasPrefix(f, "set:"):
+			r.tag = strings.TrimPrefix(f, "set:")
+		case strings.HasPrefix(f, "net:"):
+			// Deprecated spelling of set:.
+			r.tag = strings.TrimPrefix(f, "net:")
+		case !strings.Contains(f, ":"):
+			// Older dnsmasq versions accept a bare network ID.
+			r.tag = f
+		}
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return r, false
+	}
+	start, ok := parseIPv4(strings.TrimSpace(fields[0]))
+	if !ok {
+		return r, false
+	}
+	end, ok := parseIPv4(strings.TrimSpace(fields[1]))
+	if !ok {
+		return r, false
+	}
+	if end < start {
+		start, end = end, start
+	}
+	r.start, r.end = start, end
+	return r, true
+}
+
+// readDHCPRanges reads the IPv4 dhcp-range options from the dnsmasq config
+// file at path. Comments and other options are skipped.
+func readDHCPRanges(path string) ([]dhcpRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ranges []dhcpRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(name) != "dhcp-range" {
+			continue
+		}
+		if r, ok := parseDHCPRange(value); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ranges, nil
+}
+
+// confDirFiles returns the files in dir which dnsmasq reads for conf-dir,
+// i.e. all but hidden, backup (~) and emacs auto-save (#…#) files.
+func confDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() ||
+			strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, "~") ||
+			(strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#")) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths, nil
+}
+
+// dhcpRanges returns the dhcp-range options of Options.ConfFile and the files
+// in Options.ConfDir. conf-file and conf-dir options within them are not
+// followed.
+func (c *Collector) dhcpRanges() ([]dhcpRange, error) {
+	var paths []string
+	if c.confFile != "" {
+		paths = append(paths, c.confFile)
+	}
+	if c.confDir != "" {
+		files, err := confDirFiles(c.confDir)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, files...)
+	}
+	var ranges []dhcpRange
+	for _, path := range paths {
+		rs, err := readDHCPRanges(path)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, rs...)
+	}
+	return ranges, nil
+}
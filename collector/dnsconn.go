@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxDNSConns bounds the number of persistent connections, as every
+	// target gets its own.
+	maxDNSConns = 64
+
+	// dnsConnIdleTimeout is after how long without queries a persistent
+	// connection is closed.
+	dnsConnIdleTimeout = 5 * time.Minute
+)
+
+// dnsConn is a TCP (or TLS) connection to dnsmasq which is kept open across
+// stats queries, see Options.ReuseConn. Queries on the connection are
+// serialized. Reconnects are counted in reconnects.
+type dnsConn struct {
+	mu      sync.Mutex
+	conn    *dns.Conn // nil if not connected
+	dials   int
+	evicted bool // the connection is closed after the current query
+
+	reconnects prometheus.Counter
+
+	lastUsed time.Time // guarded by Collector.dnsConnsMu
+}
+
+func (c *dnsConn) dial(ctx context.Context, client *dns.Client, addr string) error {
+	if c.dials > 0 {
+		c.reconnects.Inc()
+	}
+	c.dials++
+	conn, err := client.DialContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *dnsConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// exchange sends msg to addr on the connection, connecting first if needed.
+// After an error, the connection is closed and re-established by the next
+// exchange.
+func (c *dnsConn) exchange(ctx context.Context, client *dns.Client, addr string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reused := c.conn != nil
+	if !reused {
+		if err := c.dial(ctx, client, addr); err != nil {
+			return nil, 0, err
+		}
+	}
+	in, rtt, err := client.ExchangeWithConnContext(ctx, msg, c.conn)
+	if err != nil && reused && ctx.Err() == nil {
+		// dnsmasq closes idle connections, so retry once on a new one.
+		slog.Debug("reconnecting to dnsmasq", "addr", addr, "err", err)
+		c.close()
+		if err := c.dial(ctx, client, addr); err != nil {
+			return nil, 0, err
+		}
+		in, rtt, err = client.ExchangeWithConnContext(ctx, msg, c.conn)
+	}
+	if err != nil || c.evicted {
+		c.close()
+	}
+	return in, rtt, err
+}
+
+// evict closes the connection once the current query (if any) is done.
+func (c *dnsConn) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evicted = true
+	c.close()
+}
+
+// dnsConn returns the persistent connection to the dnsmasq at addr. Before
+// adding a new one, connections which have been idle for dnsConnIdleTimeout
+// are closed, as well as the least recently used one if there are
+// maxDNSConns.
+func (c *Collector) dnsConn(addr string) *dnsConn {
+	c.dnsConnsMu.Lock()
+	defer c.dnsConnsMu.Unlock()
+	if c.dnsConns == nil {
+		c.dnsConns = make(map[string]*dnsConn)
+	}
+	now := time.Now()
+	conn, ok := c.dnsConns[addr]
+	if !ok {
+		var lru string
+		for a, other := range c.dnsConns {
+			if now.Sub(other.lastUsed) > dnsConnIdleTimeout {
+				c.evictDNSConn(a)
+				continue
+			}
+			if lru == "" || other.lastUsed.Before(c.dnsConns[lru].lastUsed) {
+				lru = a
+			}
+		}
+		if len(c.dnsConns) >= maxDNSConns {
+			c.evictDNSConn(lru)
+		}
+		conn = &dnsConn{reconnects: c.dnsReconnects}
+		c.dnsConns[addr] = conn
+	}
+	conn.lastUsed = now
+	return conn
+}
+
+// evictDNSConn removes the connection to addr. It is closed in the
+// background, as it may be in use by a query. c.dnsConnsMu must be held.
+func (c *Collector) evictDNSConn(addr string) {
+	conn := c.dnsConns[addr]
+	delete(c.dnsConns, addr)
+	slog.Debug("closing persistent connection to dnsmasq", "addr", addr)
+	go conn.evict()
+}
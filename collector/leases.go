@@ -0,0 +1,210 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// leasesReadAttempts bounds how often reading the leases file is
+	// attempted when encountering transient errors.
+	leasesReadAttempts = 3
+
+	leasesReadBackoff = 10 * time.Millisecond
+
+	// leasesCheckInterval is the number of lines after which parseLeases
+	// checks whether its context is done.
+	leasesCheckInterval = 1000
+)
+
+// retryable returns whether err is a transient error which some (e.g.
+// embedded or network) filesystems occasionally return.
+func retryable(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// readLeasesFile reads the leases file at path, retrying on transient errors.
+// Other errors (e.g. permission denied or file not found) are returned
+// immediately. If maxBytes is positive, larger files are not read. Retries are
+// counted in retries.
+func readLeasesFile(path string, maxBytes int64, retries prometheus.Counter) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < leasesReadAttempts; attempt++ {
+		if attempt > 0 {
+			retries.Inc()
+			time.Sleep(leasesReadBackoff)
+		}
+		var b []byte
+		b, err = readFileLimit(path, maxBytes)
+		if err == nil || !retryable(err) {
+			return b, err
+		}
+	}
+	return nil, err
+}
+
+// readFileLimit reads the file at path, failing if it is larger than maxBytes
+// (if positive) without reading the rest.
+func readFileLimit(path string, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		return os.ReadFile(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxBytes {
+		return nil, fmt.Errorf("%s: file larger than -max_leases_bytes=%d", path, maxBytes)
+	}
+	return b, nil
+}
+
+// Lease is a record of the leases file. Hostnames and client identifiers which
+// dnsmasq writes as "*" (i.e. the client sent none) are empty.
+type Lease struct {
+	// Expiry is a Unix timestamp, 0 for infinite leases, or -1 if it cannot
+	// be parsed (unless Options.StrictExpiry skips such records).
+	Expiry   int64  `json:"expiry"`
+	MAC      string `json:"mac,omitempty"` // normalized, see normalizeMAC
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// V6 is whether this is a DHCPv6 lease, which has an IAID and a client
+	// DUID instead of a MAC and a client identifier.
+	V6         bool   `json:"v6,omitempty"`
+	IAID       string `json:"iaid,omitempty"`
+	ClientDUID string `json:"client_duid,omitempty"`
+
+	// File is the leases file, if multiple are configured.
+	File string `json:"file,omitempty"`
+
+	// missingClientID is whether the client-id column is missing, which
+	// some configurations omit.
+	missingClientID bool
+}
+
+// parseLeases parses the contents of a leases file:
+//
+//	<expiry> <mac> <ip> <hostname> [<client-id>]
+//	duid <server-duid>
+//	<expiry> <iaid> <ip> <hostname> <client-duid>
+//
+// DHCPv6 leases follow the server DUID line. Columns are separated by any
+// whitespace. As hostnames cannot contain colons, a DHCPv4 record whose fourth
+// column contains one lacks the hostname (i.e. the client identifier shifted
+// into its column), otherwise it lacks the client identifier. Blank lines are
+// skipped, and malformed lines (e.g. truncated, with more than 5 columns, or
+// with an invalid MAC or IP address) are counted, so that garbage does not end
+// up in labels. If strictExpiry is true, lines with an unparseable expiry are
+// malformed, too, instead of having an Expiry of -1. Parsing stops when ctx is
+// done, e.g. when the scrape timed out.
+func parseLeases(ctx context.Context, b []byte, strictExpiry bool) (leases []Lease, malformed int, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	var v6 bool
+	for n := 1; scanner.Scan(); n++ {
+		if n%leasesCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, malformed, err
+			}
+		}
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		if parts[0] == "duid" {
+			v6 = true
+			continue
+		}
+		if len(parts) < 4 || (v6 && len(parts) < 5) || (!v6 && len(parts) > 5) {
+			malformed++
+			continue
+		}
+		if net.ParseIP(parts[2]) == nil || (!v6 && !validMAC(parts[1])) {
+			slog.Debug("skipping lease with invalid MAC or IP address", "mac", parts[1], "ip", parts[2])
+			malformed++
+			continue
+		}
+		expiry, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			if strictExpiry {
+				slog.Debug("skipping lease with invalid expiry", "expiry", parts[0], "ip", parts[2])
+				malformed++
+				continue
+			}
+			expiry = -1
+		}
+		l := Lease{
+			Expiry:   expiry,
+			IP:       parts[2],
+			Hostname: unknownAsEmpty(parts[3]),
+		}
+		if v6 {
+			l.V6 = true
+			l.IAID = parts[1]
+			l.ClientDUID = parts[4]
+		} else {
+			l.MAC = normalizeMAC(parts[1])
+			switch {
+			case len(parts) == 5:
+				l.ClientID = unknownAsEmpty(parts[4])
+			case strings.Contains(parts[3], ":"):
+				l.Hostname, l.ClientID = "", parts[3]
+			default:
+				l.missingClientID = true
+			}
+		}
+		leases = append(leases, l)
+	}
+	return leases, malformed, scanner.Err()
+}
+
+// validMAC returns whether mac is a hardware address as written by dnsmasq:
+// colon-separated hex bytes (e.g. 00:11:22:33:44:55), prefixed by the
+// hardware type (e.g. 20-...) for other hardware than Ethernet.
+func validMAC(mac string) bool {
+	if i := strings.IndexByte(mac, '-'); i >= 0 {
+		if i == 0 || i > 2 || !isHex(strings.ToLower(mac[:i])) {
+			return false
+		}
+		mac = mac[i+1:]
+	}
+	for _, b := range strings.Split(mac, ":") {
+		if b == "" || len(b) > 2 || !isHex(strings.ToLower(b)) {
+			return false
+		}
+	}
+	return true
+}
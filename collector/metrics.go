@@ -0,0 +1,510 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeMetrics contains the metrics built from the data gathered by a single
+// scrape. A new scrapeMetrics is created for every scrape, so that concurrent
+// scrapes do not see each other’s values, and the series of leases which
+// disappeared from the leases file are not exported anymore.
+type scrapeMetrics struct {
+	// stats contains prometheus Gauges, keyed by the stats DNS record they
+	// correspond to.
+	stats                map[string]prometheus.Gauge
+	cacheHitsOnly        prometheus.Gauge
+	cacheHitRatio        *prometheus.GaugeVec // without labels, only set when defined
+	cacheUtilization     *prometheus.GaugeVec // without labels, only set when defined
+	extraStat            *prometheus.GaugeVec
+	serversQueries       *prometheus.GaugeVec
+	serversQueriesFailed *prometheus.GaugeVec
+	serversCount         *prometheus.GaugeVec
+	isDnsmasq            prometheus.Gauge
+	versionInfo          *prometheus.GaugeVec
+	tcpFallback          prometheus.Gauge
+	dnsRTT               *prometheus.GaugeVec
+
+	leases                *prometheus.GaugeVec // by file, see fileLabel
+	leaseExpiry           *prometheus.GaugeVec
+	leaseExpiryV6         *prometheus.GaugeVec
+	leaseAge              *prometheus.GaugeVec
+	leaseTTL              *prometheus.GaugeVec
+	leasesByPrefix        *prometheus.GaugeVec
+	leasesByState         *prometheus.GaugeVec
+	leasesActive          prometheus.Gauge
+	leasesTruncated       prometheus.Gauge
+	leasesMissingClientID prometheus.Gauge
+	uniqueClientIDs       prometheus.Gauge
+	clientIDMACMismatch   prometheus.Gauge
+	leaseHostnameMismatch prometheus.Gauge
+	hostnameCollisions    prometheus.Gauge
+	leasesFileInode       *prometheus.GaugeVec // by file, see fileLabel
+	leasesFileMtime       *prometheus.GaugeVec // by file, see fileLabel
+	leasesFileBytes       *prometheus.GaugeVec // by file, see fileLabel
+	leasesParsedRecords   *prometheus.GaugeVec // by file, see fileLabel
+	leasesFilePresent     *prometheus.GaugeVec // by file, see fileLabel
+	reservations          prometheus.Gauge
+	reservationsActive    prometheus.Gauge
+	reservationsMismatch  prometheus.Gauge
+	dhcpRangeSize         *prometheus.GaugeVec
+	dhcpRangeUsed         *prometheus.GaugeVec
+	unknownMACLeases      prometheus.Gauge
+	unknownMACLeaseInfo   *prometheus.GaugeVec
+
+	scrapePhaseDuration *prometheus.GaugeVec
+	up                  prometheus.Gauge
+	lastSuccess         *prometheus.GaugeVec // without labels, only set after a successful scrape
+	scrapeResult        *prometheus.GaugeVec
+	scrapeError         *prometheus.GaugeVec
+	dnsRcode            *prometheus.GaugeVec
+}
+
+// newScrapeMetrics returns new metrics. dnsmasq_lease_expiry has the
+// expiryLeaseLabels (all LeaseLabels if nil, see Options.LeaseLabels), and
+// additional vendor and ptr labels if vendorLabel (see Options.OUIs) and
+// ptrLabel (see Options.ResolvePTR) are true. dnsmasq_lease_ttl_seconds and
+// dnsmasq_lease_age_seconds share the labels of dnsmasq_lease_expiry. If
+// fileLabel is true, the per-file metrics and dnsmasq_lease_expiry* have an
+// additional file label, see Collector.fileLabel.
+func newScrapeMetrics(expiryLeaseLabels []string, vendorLabel, ptrLabel, fileLabel bool) *scrapeMetrics {
+	if expiryLeaseLabels == nil {
+		expiryLeaseLabels = LeaseLabels
+	}
+	expiryLabels := append([]string(nil), expiryLeaseLabels...)
+	if vendorLabel {
+		expiryLabels = append(expiryLabels, "vendor")
+	}
+	if ptrLabel {
+		expiryLabels = append(expiryLabels, "ptr")
+	}
+	expiryV6Labels := append([]string(nil), leaseV6Labels...)
+	var fileLabels []string
+	if fileLabel {
+		fileLabels = []string{"file"}
+		expiryLabels = append(expiryLabels, "file")
+		expiryV6Labels = append(expiryV6Labels, "file")
+	}
+	return &scrapeMetrics{
+		stats: map[string]prometheus.Gauge{
+			"cachesize.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "dnsmasq_cachesize",
+				Help: "configured size of the DNS cache",
+			}),
+
+			"insertions.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "dnsmasq_insertions",
+				Help: "DNS cache insertions",
+			}),
+
+			"evictions.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "dnsmasq_evictions",
+				Help: "DNS cache exictions: numbers of entries which replaced an unexpired cache entry",
+			}),
+
+			"misses.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "dnsmasq_misses",
+				Help: "DNS cache misses: queries which had to be forwarded",
+			}),
+
+			"hits.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "dnsmasq_hits",
+				Help: "DNS queries answered locally (cache hits)",
+			}),
+
+			"auth.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "dnsmasq_auth",
+				Help: "DNS queries for authoritative zones",
+			}),
+		},
+
+		cacheHitsOnly: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_cache_hits_only",
+			Help: "DNS queries answered from the cache, approximated as hits minus queries for authoritative zones (dnsmasq_hits - dnsmasq_auth, clamped at 0)",
+		}),
+
+		cacheHitRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_cache_hit_ratio",
+			Help: "Fraction of DNS queries answered locally, hits / (hits + misses). Not exported before the first query",
+		}, nil),
+
+		cacheUtilization: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_cache_utilization",
+			Help: "Rough fill indicator of the DNS cache, min(insertions, cachesize) / cachesize. As insertions are counted since startup, 1 means that the cache has been full at some point, not that it is full now. Not exported if the cache is disabled",
+		}, nil),
+
+		extraStat: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_extra_stat",
+			Help: "Values of additional CHAOS TXT records configured via -extra_stats",
+		}, []string{"record"}),
+
+		serversQueries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_servers_queries",
+			Help: "Number of queries forwarded to the upstream server, as reported by servers.bind",
+		}, []string{"server"}),
+
+		serversQueriesFailed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_servers_queries_failed",
+			Help: "Number of queries forwarded to the upstream server which failed, as reported by servers.bind",
+		}, []string{"server"}),
+
+		serversCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_servers_count",
+			Help: "Number of distinct upstream servers reported by servers.bind",
+		}, nil),
+
+		isDnsmasq: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_is_dnsmasq",
+			Help: "Whether the queried server looks like dnsmasq (1), i.e. answers cachesize.bind and reports a dnsmasq version.bind, or not (0)",
+		}),
+
+		versionInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_version_info",
+			Help: "dnsmasq version as reported by version.bind, always 1",
+		}, []string{"version"}),
+
+		tcpFallback: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_dns_tcp_fallback_active",
+			Help: "Whether the last stats query was truncated over UDP and had to be retried over TCP (1) or not (0)",
+		}),
+
+		dnsRTT: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_dns_rtt_seconds",
+			Help: "Round-trip time of the stats query of the scrape (the slowest one with -dns_split_questions), including a TCP fallback. Not exported with -stats_file",
+		}, nil),
+
+		leases: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases",
+			Help: "Number of DHCP leases handed out",
+		}, fileLabels),
+
+		leaseExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_expiry",
+			Help: "Expiry time (Unix timestamp) of DHCP leases, 0 for infinite leases",
+		}, expiryLabels),
+
+		leaseExpiryV6: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_expiry_v6",
+			Help: "Expiry time (Unix timestamp) of DHCPv6 leases, 0 for infinite leases",
+		}, expiryV6Labels),
+
+		leaseAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_age_seconds",
+			Help: "Approximate time since DHCP leases were last renewed, derived from -lease_time and the lease expiry",
+		}, expiryLabels),
+
+		leaseTTL: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_ttl_seconds",
+			Help: "Time until DHCP leases expire as of the scrape, negative for expired leases. Not exported for infinite leases",
+		}, expiryLabels),
+
+		leasesByPrefix: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_by_prefix",
+			Help: "Number of DHCP leases, grouped by IP prefix of length -lease_prefix_len (IPv4) or -lease_prefix_len_v6 (IPv6)",
+		}, []string{"prefix"}),
+
+		leasesByState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_by_state",
+			Help: "Number of DHCP leases by state: active, expired (expiry in the past), or static (infinite lease)",
+		}, []string{"state"}),
+
+		leasesActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_active",
+			Help: "Number of DHCP leases which have not expired as of the scrape, including static (infinite) leases",
+		}),
+
+		leasesTruncated: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_truncated",
+			Help: "Number of DHCP leases without per-lease series because -max_lease_series was exceeded",
+		}),
+
+		leasesMissingClientID: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_missing_client_id",
+			Help: "Number of DHCP leases without client-id column in the leases file",
+		}),
+
+		uniqueClientIDs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_unique_client_ids",
+			Help: "Number of distinct DHCP client identifiers among the leases",
+		}),
+
+		clientIDMACMismatch: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_clientid_mac_mismatch",
+			Help: "Absolute difference between the number of distinct client identifiers and distinct MACs among the leases with a client identifier",
+		}),
+
+		leaseHostnameMismatch: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_hostname_dns_mismatch",
+			Help: "Number of DHCP leases whose hostname differs from the reverse DNS name of their IP (requires -resolve_ptr)",
+		}),
+
+		hostnameCollisions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_hostname_collisions",
+			Help: "Number of hostnames of more than one DHCPv4 client (distinct MACs) among the leases",
+		}),
+
+		leasesFileInode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_file_inode",
+			Help: "Inode number of the leases file, which changes when the file is replaced",
+		}, fileLabels),
+
+		leasesFileMtime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_file_mtime_seconds",
+			Help: "Modification time (Unix timestamp) of the leases file, which dnsmasq rewrites when leases change. Not exported if the file does not exist",
+		}, fileLabels),
+
+		leasesFileBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_file_bytes",
+			Help: "Number of bytes read from the leases file, 0 if it does not exist",
+		}, fileLabels),
+
+		leasesParsedRecords: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_parsed_records",
+			Help: "Number of records parsed from the leases file, excluding blank, DUID and malformed lines (see dnsmasq_lease_parse_errors_total)",
+		}, fileLabels),
+
+		leasesFilePresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_file_present",
+			Help: "Whether the leases file exists (1) or not (0), e.g. because DHCP is disabled. A missing leases file is exported as 0 leases",
+		}, fileLabels),
+
+		reservations: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_reservations",
+			Help: "Number of static DHCP reservations listed in -reservations_file",
+		}),
+
+		reservationsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_reservations_active",
+			Help: "Number of static DHCP reservations whose MAC holds a lease for the reserved IP",
+		}),
+
+		reservationsMismatch: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_reservations_ip_mismatch",
+			Help: "Number of static DHCP reservations whose MAC holds leases, but none for the reserved IP",
+		}),
+
+		dhcpRangeSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_dhcp_range_size",
+			Help: "Number of IPv4 addresses in the dhcp-range options of -conf_file and -conf_dir",
+		}, []string{"tag", "range"}),
+
+		dhcpRangeUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_dhcp_range_used",
+			Help: "Number of DHCP leases for IPv4 addresses within the dhcp-range options of -conf_file and -conf_dir",
+		}, []string{"tag", "range"}),
+
+		unknownMACLeases: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_leases_unknown_mac",
+			Help: "Number of unexpired DHCP leases (including static leases) handed out to MACs not listed in -known_macs_file",
+		}),
+
+		unknownMACLeaseInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_lease_unknown_mac_info",
+			Help: "Unexpired DHCP leases handed out to MACs not listed in -known_macs_file",
+		}, []string{"mac_addr", "ip_addr"}),
+
+		scrapePhaseDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_scrape_phase_duration_seconds",
+			Help: "Duration of the last scrape’s phases: querying dnsmasq (dns), reading the leases file (leases), and both including the wait for completion (total)",
+		}, []string{"phase"}),
+
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dnsmasq_up",
+			Help: "Whether the last scrape succeeded (1), or querying dnsmasq or reading the leases file failed (0)",
+		}),
+
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_last_scrape_success_timestamp_seconds",
+			Help: "Time (Unix timestamp) of the last scrape which succeeded in both querying dnsmasq and reading the leases file. Not exported before the first successful scrape",
+		}, nil),
+
+		scrapeResult: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_scrape_result",
+			Help: "Outcome of the last scrape, exactly one of the results is 1: ok, dns_failed, leases_failed, both_failed, or timeout (querying dnsmasq timed out)",
+		}, []string{"result"}),
+
+		scrapeError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_scrape_error",
+			Help: "Reason why the last scrape failed, always 1: dns_timeout, dns_error, dns_rcode, dns_parse, leases_timeout, leases_open or leases_read. Not exported for successful scrapes",
+		}, []string{"reason"}),
+
+		dnsRcode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dnsmasq_dns_rcode",
+			Help: "Response code of the stats queries of the last scrape, always 1: NOERROR, or the first other rcode (e.g. REFUSED), which fails the scrape. Not exported if dnsmasq did not answer or with -stats_file",
+		}, []string{"rcode"}),
+	}
+}
+
+// dnsCollectors returns the metrics built from the stats queries.
+func (m *scrapeMetrics) dnsCollectors() []prometheus.Collector {
+	cs := []prometheus.Collector{
+		m.cacheHitsOnly,
+		m.cacheHitRatio,
+		m.cacheUtilization,
+		m.extraStat,
+		m.serversQueries,
+		m.serversQueriesFailed,
+		m.serversCount,
+		m.isDnsmasq,
+		m.versionInfo,
+		m.tcpFallback,
+		m.dnsRTT,
+	}
+	for _, g := range m.stats {
+		cs = append(cs, g)
+	}
+	return cs
+}
+
+// leaseCollectors returns the metrics built from the leases file.
+func (m *scrapeMetrics) leaseCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.leases,
+		m.leaseExpiry,
+		m.leaseExpiryV6,
+		m.leaseAge,
+		m.leaseTTL,
+		m.leasesByPrefix,
+		m.leasesByState,
+		m.leasesActive,
+		m.leasesTruncated,
+		m.leasesMissingClientID,
+		m.uniqueClientIDs,
+		m.clientIDMACMismatch,
+		m.leaseHostnameMismatch,
+		m.hostnameCollisions,
+		m.leasesFileInode,
+		m.leasesFileMtime,
+		m.leasesFileBytes,
+		m.leasesParsedRecords,
+		m.leasesFilePresent,
+		m.reservations,
+		m.reservationsActive,
+		m.reservationsMismatch,
+		m.dhcpRangeSize,
+		m.dhcpRangeUsed,
+		m.unknownMACLeases,
+		m.unknownMACLeaseInfo,
+	}
+}
+
+// scrapeCollectors returns the metrics describing the scrape itself.
+func (m *scrapeMetrics) scrapeCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.scrapePhaseDuration,
+		m.up,
+		m.lastSuccess,
+		m.scrapeResult,
+		m.scrapeError,
+		m.dnsRcode,
+	}
+}
+
+// scrapeCollector is a prometheus.Collector which queries dnsmasq and reads
+// the leases file on every Collect, unless a cached collection is available
+// (see Options.CacheDuration).
+type scrapeCollector struct {
+	ctx     context.Context
+	c       *Collector
+	target  Target
+	subnets []*net.IPNet
+}
+
+// newScrapeMetrics returns new metrics for sc's target.
+func (sc scrapeCollector) newScrapeMetrics() *scrapeMetrics {
+	return newScrapeMetrics(sc.c.leaseLabels, sc.c.ouis != nil, sc.c.ptr != nil, sc.c.fileLabel(sc.target))
+}
+
+// newScrapeDuration returns the gauge of the duration of a single Collect of
+// a scrapeCollector. Unlike the scrapeMetrics, it is not shared by the scrapes
+// served a cached or background collection.
+func newScrapeDuration() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dnsmasq_scrape_duration_seconds",
+		Help: "Duration of the scrape, including the wait for a cached or background collection",
+	})
+}
+
+func (sc scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	newScrapeDuration().Describe(ch)
+	m := sc.newScrapeMetrics()
+	for _, cs := range [][]prometheus.Collector{m.dnsCollectors(), m.leaseCollectors(), m.scrapeCollectors(), sc.c.counters()} {
+		for _, c := range cs {
+			c.Describe(ch)
+		}
+	}
+}
+
+// collect queries dnsmasq and reads the leases file, aborting when ctx is
+// done.
+func (sc scrapeCollector) collect(ctx context.Context) collection {
+	m := sc.newScrapeMetrics()
+	dnsErr, leasesErr := sc.c.collect(ctx, m, sc.target, sc.subnets)
+	if dnsErr != nil {
+		slog.Error("querying dnsmasq failed", "addr", sc.target.DnsmasqAddr, "err", dnsErr)
+	}
+	if leasesErr != nil {
+		slog.Error("reading leases failed", "path", sc.target.LeasesPath, "err", leasesErr)
+	}
+	return collection{m: m, dnsErr: dnsErr, leasesErr: leasesErr}
+}
+
+// Collect collects the metrics of a new scrape, unless a background (see
+// Options.CollectInterval) or cached collection is available. The metrics of
+// a failed subsystem (querying dnsmasq or reading the leases file) are left
+// out, see dnsmasq_up and dnsmasq_scrape_result.
+func (sc scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	key := cacheKey(sc.target, sc.subnets)
+	col, ok := collection{}, false
+	if sc.c.background != nil {
+		// Other targets and subnets are still collected per scrape.
+		col, ok = sc.c.background.get(sc.ctx, key)
+	}
+	switch {
+	case ok:
+	case sc.c.cache != nil:
+		// The shared collection is bounded like its stats queries.
+		var err error
+		col, err = sc.c.cache.get(sc.ctx, key, sc.c.sharedExchangeTimeout(), sc.collect)
+		if err != nil {
+			// The scrape gave up waiting for the collection.
+			m := sc.newScrapeMetrics()
+			m.setScrapeResult(err, err)
+			col = collection{m: m, dnsErr: err, leasesErr: err}
+		}
+	default:
+		col = sc.collect(sc.ctx)
+	}
+	cs := append(col.m.scrapeCollectors(), sc.c.counters()...)
+	if col.dnsErr == nil {
+		cs = append(cs, col.m.dnsCollectors()...)
+	}
+	if col.leasesErr == nil {
+		cs = append(cs, col.m.leaseCollectors()...)
+	}
+	duration := newScrapeDuration()
+	duration.Set(time.Since(start).Seconds())
+	cs = append(cs, duration)
+	for _, c := range cs {
+		c.Collect(ch)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// unknownVendor is the vendor label of leases whose MAC prefix is not listed
+// in Options.OUIs.
+const unknownVendor = "unknown"
+
+var macSeparators = strings.NewReplacer(":", "", "-", "", ".", "")
+
+// ouiPrefix returns the OUI (the first three octets) of mac in lower-case
+// hex without separators, or "" if mac is too short.
+func ouiPrefix(mac string) string {
+	prefix := macSeparators.Replace(strings.ToLower(mac))
+	if len(prefix) < 6 {
+		return ""
+	}
+	return prefix[:6]
+}
+
+// ReadOUIs reads a file mapping MAC prefixes to vendors, one per line:
+//
+//	00:00:0c Cisco Systems, Inc
+//	00-1A-11 Google, Inc.
+//
+// The IEEE registry (oui.txt) can be used as is: its "(hex)" lines match this
+// format and all other lines are skipped, as are blank lines and comments
+// (starting with #).
+func ReadOUIs(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		prefix := macSeparators.Replace(strings.ToLower(fields[0]))
+		if len(prefix) != 6 || !isHex(prefix) {
+			continue
+		}
+		fields = fields[1:]
+		if fields[0] == "(base" {
+			// The "(base 16)" lines of oui.txt repeat the "(hex)" lines.
+			continue
+		}
+		if fields[0] == "(hex)" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			vendors[prefix] = strings.Join(fields, " ")
+		}
+	}
+	return vendors, scanner.Err()
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// vendor returns the vendor of mac according to vendors, or unknownVendor.
+func vendor(vendors map[string]string, mac string) string {
+	if v, ok := vendors[ouiPrefix(mac)]; ok {
+		return v
+	}
+	return unknownVendor
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ptrCacheTTL is how long successful reverse lookups are cached. Lease
+	// IPs are typically stable for much longer.
+	ptrCacheTTL = 1 * time.Hour
+
+	// ptrNegativeCacheTTL is how long failed reverse lookups are cached.
+	ptrNegativeCacheTTL = 5 * time.Minute
+
+	// ptrCacheSize bounds the number of cached reverse lookups.
+	ptrCacheSize = 4096
+)
+
+type ptrEntry struct {
+	name    string // empty if the lookup failed
+	expires time.Time
+}
+
+// ptrResolver performs cached reverse (PTR) lookups of lease IPs.
+type ptrResolver struct {
+	query func(context.Context, *dns.Msg) (*dns.Msg, error)
+
+	mu    sync.Mutex
+	cache map[string]ptrEntry
+}
+
+func newPTRResolver(query func(context.Context, *dns.Msg) (*dns.Msg, error)) *ptrResolver {
+	return &ptrResolver{
+		query: query,
+		cache: make(map[string]ptrEntry),
+	}
+}
+
+// lookup returns the name the PTR record of ip points to, without trailing
+// dot. Uncached lookups are abandoned at deadline, in which case lookup returns
+// false without caching the failure.
+func (p *ptrResolver) lookup(ip string, deadline time.Time) (string, bool) {
+	now := time.Now()
+	p.mu.Lock()
+	entry, ok := p.cache[ip]
+	p.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.name, entry.name != ""
+	}
+	if !now.Before(deadline) {
+		return "", false
+	}
+
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return "", false
+	}
+	ctx, canc := context.WithDeadline(context.Background(), deadline)
+	defer canc()
+	var msg dns.Msg
+	msg.SetQuestion(name, dns.TypePTR)
+	in, err := p.query(ctx, &msg)
+	if err != nil {
+		return "", false // transient, do not cache
+	}
+	entry = ptrEntry{expires: now.Add(ptrNegativeCacheTTL)}
+	for _, a := range in.Answer {
+		if ptr, ok := a.(*dns.PTR); ok {
+			entry = ptrEntry{
+				name:    strings.TrimSuffix(ptr.Ptr, "."),
+				expires: now.Add(ptrCacheTTL),
+			}
+			break
+		}
+	}
+	p.store(ip, entry, now)
+	return entry.name, entry.name != ""
+}
+
+func (p *ptrResolver) store(ip string, entry ptrEntry, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= ptrCacheSize {
+		for ip, entry := range p.cache {
+			if !now.Before(entry.expires) {
+				delete(p.cache, ip)
+			}
+		}
+	}
+	if len(p.cache) >= ptrCacheSize {
+		return
+	}
+	p.cache[ip] = entry
+}
+
+// hostnameMatches returns whether the lease hostname matches the reverse DNS
+// name ptr. dnsmasq records the (unqualified) name sent by the client, so only
+// the first label of ptr is compared, case-insensitively.
+func hostnameMatches(hostname, ptr string) bool {
+	if i := strings.IndexByte(ptr, '.'); i > -1 && !strings.Contains(hostname, ".") {
+		ptr = ptr[:i]
+	}
+	return strings.EqualFold(hostname, ptr)
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// traceContext is the trace context of a scrape request, see
+// https://www.w3.org/TR/trace-context/.
+type traceContext struct {
+	traceID string
+	spanID  string
+}
+
+// exemplar returns the labels of an exemplar linking to the trace.
+func (tc traceContext) exemplar() prometheus.Labels {
+	return prometheus.Labels{"trace_id": tc.traceID, "span_id": tc.spanID}
+}
+
+// parseTraceparent parses the traceparent header of a request, e.g.
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+// It returns false if traceparent is not valid.
+func parseTraceparent(traceparent string) (traceContext, bool) {
+	fields := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(fields) < 4 {
+		return traceContext{}, false
+	}
+	version, traceID, spanID := fields[0], fields[1], fields[2]
+	// Version ff is invalid, later versions may append fields.
+	if len(version) != 2 || !isHex(version) || version == "ff" || (version == "00" && len(fields) != 4) {
+		return traceContext{}, false
+	}
+	if len(traceID) != 32 || !isHex(traceID) || traceID == strings.Repeat("0", 32) ||
+		len(spanID) != 16 || !isHex(spanID) || spanID == strings.Repeat("0", 16) {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: traceID, spanID: spanID}, true
+}
+
+type traceContextKey struct{}
+
+// WithTraceparent returns a copy of ctx carrying the trace context of the
+// traceparent header of a scrape request, which is attached as exemplar to the
+// dnsmasq_dns_query_duration_seconds observations of scrapes with ctx. ctx is
+// returned as is if traceparent is not valid.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	tc, ok := parseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// traceContextFrom returns the trace context of the scrape request of ctx.
+func traceContextFrom(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return tc, ok
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig sets the flags in fs from the YAML file at path, which maps flag
+// names (without leading dash) to values, e.g.:
+//
+//	listen: localhost:9153
+//	dns_timeout: 2s
+//	stats_records: [cachesize.bind, hits.bind, misses.bind]
+//
+// Lists are joined with commas. Flags which were already set (on the command
+// line or by setFlagsFromEnv) take precedence over the file, so loadConfig
+// must be called after fs.Parse.
+func loadConfig(path string, fs *flag.FlagSet) error {
+	values, err := readConfig(path, fs)
+	if err != nil {
+		return err
+	}
+	set := setFlags(fs)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// readConfig returns the flag values of the config file at path (see
+// loadConfig) by flag name.
+func readConfig(path string, fs *flag.FlagSet) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	flags := make(map[string]string, len(values))
+	for name, v := range values {
+		if name == "config.file" || fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		flags[name] = configValue(v)
+	}
+	return flags, nil
+}
+
+// setFlags returns the names of the flags in fs which have been set.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// reloadConfig sets the flags in fs from the config file at path again, e.g.
+// after it was edited. Flags which are not (or no longer) in the file are
+// reset to their default. pinned are the flags set on the command line or in
+// the environment before the file was first loaded (see setFlags), which are
+// left alone. reloadConfig returns the names of the flags whose value changed.
+// If any value is invalid, no flag is changed.
+func reloadConfig(path string, fs *flag.FlagSet, pinned map[string]bool) ([]string, error) {
+	values, err := readConfig(path, fs)
+	if err != nil {
+		return nil, err
+	}
+	var names, previous []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if name := f.Name; !pinned[name] && name != "config.file" {
+			names = append(names, name)
+			previous = append(previous, f.Value.String())
+		}
+	})
+	for i, name := range names {
+		value, ok := values[name]
+		if !ok {
+			value = fs.Lookup(name).DefValue
+		}
+		if err := fs.Set(name, value); err != nil {
+			// Restore the flags set so far, including this one, which
+			// some flag types change even if Set fails.
+			for j := 0; j <= i; j++ {
+				fs.Set(names[j], previous[j])
+			}
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	var changed []string
+	for i, name := range names {
+		if fs.Lookup(name).Value.String() != previous[i] {
+			changed = append(changed, name)
+		}
+	}
+	return changed, nil
+}
+
+// envPrefix is the prefix of the environment variables read by
+// setFlagsFromEnv.
+const envPrefix = "DNSMASQ_EXPORTER_"
+
+// envName returns the environment variable for the flag name, e.g.
+// DNSMASQ_EXPORTER_LOG_LEVEL for -log.level.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// setFlagsFromEnv sets the flags in fs which were not set on the command line
+// from their environment variable (see envName), as returned by lookupEnv
+// (e.g. os.LookupEnv). It must be called after fs.Parse and before
+// loadConfig, so that environment variables take precedence over the config
+// file.
+func setFlagsFromEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := setFlags(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if v, ok := lookupEnv(name); ok {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("%s: %v", name, serr)
+			}
+		}
+	})
+	return err
+}
+
+// configValue returns the flag value for the YAML value v.
+func configValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		elems := make([]string, len(list))
+		for i, elem := range list {
+			elems[i] = fmt.Sprint(elem)
+		}
+		return strings.Join(elems, ",")
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
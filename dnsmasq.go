@@ -16,197 +16,1137 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/netip"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
+	"github.com/google/dnsmasq_exporter/collector"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
 )
 
 var (
+	configFile = flag.String("config.file",
+		"",
+		"if non-empty, path to a YAML file mapping flag names to values, e.g. \"dnsmasq: localhost:5353\". Flags specified on the command line take precedence")
+
 	listen = flag.String("listen",
 		"localhost:9153",
-		"listen address")
+		"comma-separated list of listen addresses, each either a TCP address or unix:<path> to listen on a Unix domain socket. A hostname is listened on at all of its addresses (e.g. 127.0.0.1 and ::1 for localhost)")
+
+	listenNetwork = flag.String("listen_network",
+		"tcp",
+		"network of the TCP addresses of -listen: tcp (IPv4 and IPv6), tcp4 (IPv4 only) or tcp6 (IPv6 only)")
+
+	logLevel = flag.String("log.level",
+		"info",
+		"only log messages with the given severity or above: debug, info, warn or error")
+
+	logFormat = flag.String("log.format",
+		"logfmt",
+		"log format: logfmt or json")
+
+	logRequests = flag.Bool("log_requests",
+		false,
+		"log every HTTP request (method, path, remote address, status and duration) at info level, e.g. to audit who reads the leases")
 
 	leasesPath = flag.String("leases_path",
 		"/var/lib/misc/dnsmasq.leases",
-		"path to the dnsmasq leases file")
+		"path to the dnsmasq leases file, or a comma-separated list of paths or glob patterns whose records are exported with a file label")
+
+	maxLeasesBytes = flag.Int64("max_leases_bytes",
+		0,
+		"if positive, leases files larger than this many bytes are not read, failing the scrape (dnsmasq_up 0) instead of consuming unbounded memory")
+
+	once = flag.Bool("once",
+		false,
+		"collect the metrics once, print them to stdout and exit (non-zero if the scrape failed) instead of serving HTTP, e.g. for debugging or cron jobs")
+
+	strictExpiry = flag.Bool("strict_expiry",
+		false,
+		"skip leases whose expiry cannot be parsed, counting them in dnsmasq_lease_parse_errors_total, instead of exporting them with an expiry of -1")
 
 	dnsmasqAddr = flag.String("dnsmasq",
 		"localhost:53",
-		"dnsmasq host:port address")
+		"dnsmasq address: host:port, [IPv6]:port, or a host (port 53)")
 	metricsPath = flag.String("metrics_path",
 		"/metrics",
-		"path under which metrics are served")
+		"comma-separated list of paths under which metrics are served")
+
+	dnsSourceAddr = flag.String("dns_source_addr",
+		"",
+		"if non-empty, local IP address from which to send the stats queries")
+
+	dnsSourcePort = flag.Int("dns_source_port",
+		0,
+		"if non-zero, local port from which to send the stats queries (e.g. for firewalls that only allow queries from a fixed port). Queries are serialized, as only one can use the port at a time")
+
+	dnsIDStrategy = flag.String("dns_id_strategy",
+		"random",
+		"how to pick the ID of the stats queries: random, sequential (starting at 1) or fixed (always 0)")
+
+	dnsQnameCase = flag.String("dns_qname_case",
+		"preserve",
+		"case of the stats query names: preserve (as configured, i.e. lower case for the built-in records), lower, or random (0x20 encoding)")
+
+	cacheDuration = flag.Duration("cache_duration",
+		0,
+		"if non-zero, serve the metrics of the last scrape for this long instead of querying dnsmasq and reading the leases file again")
+
+	collectInterval = flag.Duration("collect_interval",
+		0,
+		"if non-zero, query dnsmasq and read the leases file in the background at this interval, and serve the latest collection on scrapes of the metrics paths instead")
+
+	dnsProtocol = flag.String("dns_protocol",
+		"udp",
+		"protocol for the stats queries to dnsmasq, one of udp, tcp or tcp-tls (DNS over TLS, see -dns_tls_ca). Truncated UDP replies are retried over TCP")
+
+	dnsReuseConn = flag.Bool("dns_reuse_conn",
+		false,
+		"with -dns_protocol=tcp or tcp-tls, keep the connection to dnsmasq open across scrapes instead of connecting for every query. Reconnects are counted in dnsmasq_dns_reconnects_total")
+
+	dnsTLSCA = flag.String("dns_tls_ca",
+		"",
+		"path to PEM-encoded CA certificates to verify the certificate of dnsmasq against with -dns_protocol=tcp-tls, instead of the system roots")
+
+	dnsTLSInsecure = flag.Bool("dns_tls_insecure",
+		false,
+		"do not verify the certificate of dnsmasq with -dns_protocol=tcp-tls")
+
+	dnsTimeout = flag.Duration("dns_timeout",
+		5*time.Second,
+		"timeout for the stats queries to dnsmasq. A shorter scrape_timeout sent by Prometheus takes precedence")
+
+	singleInflight = flag.Bool("single_inflight",
+		true,
+		"share the stats query (and its answer) among concurrent scrapes sending the same questions to the same dnsmasq, instead of each sending its own")
+
+	dnsSplitQuestions = flag.Bool("dns_split_questions",
+		false,
+		"send each stats record as a separate (concurrent) query instead of one query with multiple questions, for dnsmasq versions or intermediate resolvers which only answer the first question")
+
+	dnsRetries = flag.Int("dns_retries",
+		2,
+		"number of times a stats query is retried after a transport error (e.g. a timeout). Error responses (e.g. REFUSED) are not retried")
+
+	dnsRecursion = flag.Bool("dns_recursion",
+		true,
+		"set the recursion desired (RD) bit on the CHAOS stats queries. Recursion does not apply to these queries, but the bit has always been set for compatibility")
+
+	udpBufferSize = flag.Int("udp_buffer_size",
+		4096,
+		"UDP payload size advertised via EDNS0 on the stats queries, so that large servers.bind answers are not truncated (512 to 65535, 0 to disable EDNS0)")
+
+	summaryPath = flag.String("summary_path",
+		"/metrics/summary",
+		"path under which all metrics except for the high-cardinality per-lease series are served, empty to disable")
+
+	scrapePath = flag.String("scrape_path",
+		"/scrape",
+		"path under which the metrics of the dnsmasq instance given by the target URL parameter (host:port) are served, empty to disable")
+
+	scrapeLeasesDir = flag.String("scrape_leases_dir",
+		"",
+		"directory containing the leases files which can be selected via the leases_path URL parameter of -scrape_path. If empty, the parameter is rejected")
+
+	statsRecords = flag.String("stats_records",
+		strings.Join(collector.DefaultStatsRecords, ","),
+		"comma-separated list of CHAOS TXT records to query. Records without a dedicated metric are exported as dnsmasq_extra_stat, version.bind is always queried")
+
+	extraStats = flag.String("extra_stats",
+		"",
+		"comma-separated list of additional CHAOS TXT records with numeric values to query (e.g. tftp.bind for builds which provide it), exported as dnsmasq_extra_stat")
+
+	statsFile = flag.String("stats_file",
+		"",
+		"if non-empty, path to a file containing saved dig output for the *.bind CHAOS TXT records, used instead of querying dnsmasq")
+
+	reservationsFile = flag.String("reservations_file",
+		"",
+		"if non-empty, path to a file listing static DHCP reservations (one \"<mac> <ip>\" pair per line), used to check that reserved hosts hold their reserved IP")
+
+	confFile = flag.String("conf_file",
+		"",
+		"if non-empty, path to the dnsmasq config file, from which the dhcp-range options are read to export the size and utilization of each DHCP range")
+
+	confDir = flag.String("conf_dir",
+		"",
+		"if non-empty, path to the dnsmasq config directory (conf-dir), whose files are read like -conf_file")
+
+	leaseSubnets = flag.String("lease_subnets",
+		"",
+		"if non-empty, comma-separated list of CIDR subnets: per-lease series are only exported for leases within them (overridden by the subnet URL parameter)")
+
+	leasePrefixLen = flag.Int("lease_prefix_len",
+		24,
+		"IPv4 prefix length by which leases are grouped in dnsmasq_leases_by_prefix, 0 to not group IPv4 leases. Also available as -subnet_prefix_len")
+
+	leasePrefixLenV6 = flag.Int("lease_prefix_len_v6",
+		64,
+		"IPv6 prefix length by which DHCPv6 leases are grouped in dnsmasq_leases_by_prefix, 0 to not group IPv6 leases")
+
+	resolvePTR = flag.Bool("resolve_ptr",
+		false,
+		"perform reverse (PTR) lookups of lease IPs via dnsmasq: the name is exported as ptr label of dnsmasq_lease_expiry (empty if the lookup fails) and, for leases without hostname (*), used as computer_name label. For all others, mismatches are counted in dnsmasq_lease_hostname_dns_mismatch. Lookups are cached")
+
+	resolvePTRTimeout = flag.Duration("resolve_ptr_timeout",
+		1*time.Second,
+		"time budget per scrape for uncached reverse lookups (see -resolve_ptr)")
+
+	leaseTime = flag.Duration("lease_time",
+		0,
+		"DHCP lease time configured in dnsmasq (dhcp-range). If non-zero, the approximate age of each lease is exported")
+
+	nativeHistograms = flag.Bool("native_histograms",
+		false,
+		"additionally expose dnsmasq_dns_query_duration_seconds as a native (sparse) histogram, for Prometheus servers with native histograms enabled")
+
+	addHostnameLabel = flag.Bool("add_hostname_label",
+		false,
+		"add a hostname label containing the host’s hostname to all metrics, e.g. when metrics are pushed and lose their instance label")
+
+	enableH2C = flag.Bool("h2c",
+		false,
+		"serve HTTP/2 over cleartext (h2c) in addition to HTTP/1.1")
+
+	queryLogPath = flag.String("query_log_path",
+		"",
+		"if non-empty, path to the dnsmasq log file (log-facility) with log-queries enabled, which is tailed to export dnsmasq_queries_by_type_total")
+
+	queryLogClients = flag.Bool("query_log_clients",
+		false,
+		"additionally export dnsmasq_client_queries_total by client address from -query_log_path. Each client is a separate series, so mind the cardinality on large networks")
+
+	enableLeasesEndpoint = flag.Bool("enable_leases_endpoint",
+		false,
+		"serve the parsed leases as JSON under /leases. Leases contain personal data such as MAC addresses and hostnames, so only enable this on trusted networks")
+
+	enablePprof = flag.Bool("enable_pprof",
+		false,
+		"serve Go runtime profiles under /debug/pprof/. Profiles reveal internals of the exporter, so only enable this on trusted networks")
+
+	metricNamespace = flag.String("metric_namespace",
+		"dnsmasq",
+		"namespace (prefix) of all metric names, e.g. dnsmasq_leases")
+
+	tlsCert = flag.String("tls_cert",
+		"",
+		"path to a PEM-encoded TLS certificate (chain). If set together with -tls_key, metrics are served over HTTPS")
+
+	tlsKey = flag.String("tls_key",
+		"",
+		"path to the PEM-encoded private key for -tls_cert")
+
+	knownMACsFile = flag.String("known_macs_file",
+		"",
+		"if non-empty, path to a file listing known MAC addresses (one per line), used to count unexpired leases handed out to unknown MACs")
+
+	leaseLabelsFlag = flag.String("lease_labels",
+		strings.Join(collector.LeaseLabels, ","),
+		"comma-separated subset of the labels of dnsmasq_lease_expiry ("+strings.Join(collector.LeaseLabels, ", ")+"), e.g. to drop MAC addresses and client IDs for privacy or cardinality")
+
+	stripDomain = flag.String("strip_domain",
+		"",
+		"if non-empty, domain suffix (e.g. lan) removed from the computer_name label of leases. A trailing dot is always removed")
+
+	exposeLeases = flag.Bool("expose_leases",
+		true,
+		"export per-lease series (dnsmasq_lease_expiry etc.). Disable on large DHCP servers to only export aggregates such as dnsmasq_leases")
+
+	maxLeaseSeries = flag.Int("max_lease_series",
+		0,
+		"if positive, per-lease series are only exported for this many leases, the ones expiring soonest. The number of omitted leases is exported as dnsmasq_leases_truncated")
+
+	exposeUnknownMACs = flag.Bool("expose_unknown_macs",
+		false,
+		"export a dnsmasq_lease_unknown_mac_info series for each unexpired lease handed out to an unknown MAC (requires -known_macs_file)")
+
+	ouiFile = flag.String("oui_file",
+		"",
+		"if non-empty, path to a file mapping MAC prefixes to vendors (e.g. the IEEE oui.txt), used to add a vendor label to dnsmasq_lease_expiry. Read once on startup")
 )
 
+// parseLeaseLabels parses the comma-separated subset of collector.LeaseLabels
+// given by -lease_labels, returning them in the order of collector.LeaseLabels.
+func parseLeaseLabels(s string) ([]string, error) {
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, l := range collector.LeaseLabels {
+			found = found || l == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown lease label %q, want one of %s", name, strings.Join(collector.LeaseLabels, ", "))
+		}
+		selected[name] = true
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no lease labels, want at least one of %s", strings.Join(collector.LeaseLabels, ", "))
+	}
+	labels := []string{}
+	for _, l := range collector.LeaseLabels {
+		if selected[l] {
+			labels = append(labels, l)
+		}
+	}
+	return labels, nil
+}
+
+// perLeaseMetrics contains the names of metrics with one series per lease,
+// which are excluded from -summary_path.
+var perLeaseMetrics = map[string]bool{
+	"dnsmasq_lease_expiry":           true,
+	"dnsmasq_lease_expiry_v6":        true,
+	"dnsmasq_lease_age_seconds":      true,
+	"dnsmasq_lease_ttl_seconds":      true,
+	"dnsmasq_lease_unknown_mac_info": true,
+}
+
+// withoutPerLeaseMetrics returns a prometheus.Gatherer which gathers everything
+// from g except for the perLeaseMetrics.
+func withoutPerLeaseMetrics(g prometheus.Gatherer) prometheus.Gatherer {
+	return filteredGatherer{
+		Gatherer: g,
+		keep:     func(name string) bool { return !perLeaseMetrics[name] },
+	}
+}
+
 var (
-	// floatMetrics contains prometheus Gauges, keyed by the stats DNS record
-	// they correspond to.
-	floatMetrics = map[string]prometheus.Gauge{
-		"cachesize.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "dnsmasq_cachesize",
-			Help: "configured size of the DNS cache",
-		}),
-
-		"insertions.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "dnsmasq_insertions",
-			Help: "DNS cache insertions",
-		}),
-
-		"evictions.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "dnsmasq_evictions",
-			Help: "DNS cache exictions: numbers of entries which replaced an unexpired cache entry",
-		}),
-
-		"misses.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "dnsmasq_misses",
-			Help: "DNS cache misses: queries which had to be forwarded",
-		}),
-
-		"hits.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "dnsmasq_hits",
-			Help: "DNS queries answered locally (cache hits)",
-		}),
-
-		"auth.bind.": prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "dnsmasq_auth",
-			Help: "DNS queries for authoritative zones",
-		}),
-	}
-
-	leases = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "dnsmasq_leases",
-		Help: "Number of DHCP leases handed out",
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dnsmasq_exporter_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests served by the exporter",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path", "code"})
+
+	scrapesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dnsmasq_exporter_scrapes_in_flight",
+		Help: "Number of scrapes currently being served",
+	})
+
+	listenInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dnsmasq_exporter_listen_info",
+		Help: "Addresses the exporter listens on, with value 1",
+	}, []string{"address"})
+
+	scrapesInFlightMax = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dnsmasq_exporter_scrapes_in_flight_max",
+		Help: "Highest number of concurrently served scrapes since the exporter started",
 	})
 )
 
+// The metrics of dnsmasq are collected per scrape, see collector.Collector.
+// Only the metrics of the exporter itself are registered globally.
 func init() {
-	for _, g := range floatMetrics {
-		prometheus.MustRegister(g)
+	flag.IntVar(leasePrefixLen, "subnet_prefix_len", *leasePrefixLen, "alias of -lease_prefix_len")
+
+	prometheus.MustRegister(versioncollector.NewCollector("dnsmasq_exporter"))
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(scrapesInFlight)
+	prometheus.MustRegister(scrapesInFlightMax)
+	prometheus.MustRegister(listenInfo)
+	prometheus.MustRegister(queriesByType)
+	prometheus.MustRegister(clientQueries)
+	if err := registerRuntimeCollectors(prometheus.DefaultRegisterer); err != nil {
+		panic(err)
 	}
-	prometheus.MustRegister(leases)
 }
 
-// From https://manpages.debian.org/stretch/dnsmasq-base/dnsmasq.8.en.html:
-// The cache statistics are also available in the DNS as answers to queries of
-// class CHAOS and type TXT in domain bind. The domain names are cachesize.bind,
-// insertions.bind, evictions.bind, misses.bind, hits.bind, auth.bind and
-// servers.bind. An example command to query this, using the dig utility would
-// be:
-//     dig +short chaos txt cachesize.bind
+// registerRuntimeCollectors registers the Go runtime (go_*) and process
+// (process_*) collectors with reg, unless it already has them, like the
+// default registry.
+func registerRuntimeCollectors(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		if err := reg.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-type server struct {
-	promHandler http.Handler
-	dnsClient   *dns.Client
-	dnsmasqAddr string
-	leasesPath  string
+// parseRecords parses a comma-separated list of record names.
+func parseRecords(list string) []string {
+	var records []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			records = append(records, dns.Fqdn(name))
+		}
+	}
+	return records
 }
 
-func (s *server) metrics(w http.ResponseWriter, r *http.Request) {
-	var eg errgroup.Group
-
-	eg.Go(func() error {
-		msg := &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Id:               dns.Id(),
-				RecursionDesired: true,
-			},
-			Question: []dns.Question{
-				dns.Question{"cachesize.bind.", dns.TypeTXT, dns.ClassCHAOS},
-				dns.Question{"insertions.bind.", dns.TypeTXT, dns.ClassCHAOS},
-				dns.Question{"evictions.bind.", dns.TypeTXT, dns.ClassCHAOS},
-				dns.Question{"misses.bind.", dns.TypeTXT, dns.ClassCHAOS},
-				dns.Question{"hits.bind.", dns.TypeTXT, dns.ClassCHAOS},
-				dns.Question{"auth.bind.", dns.TypeTXT, dns.ClassCHAOS},
-				dns.Question{"servers.bind.", dns.TypeTXT, dns.ClassCHAOS},
-			},
-		}
-		in, _, err := s.dnsClient.Exchange(msg, s.dnsmasqAddr)
-		if err != nil {
-			return err
+// newQueryIDFunc returns a function generating query IDs according to
+// strategy, see -dns_id_strategy.
+func newQueryIDFunc(strategy string) (func() uint16, error) {
+	switch strategy {
+	case "random":
+		return dns.Id, nil
+	case "sequential":
+		var id uint32
+		return func() uint16 { return uint16(atomic.AddUint32(&id, 1)) }, nil
+	case "fixed":
+		return func() uint16 { return 0 }, nil
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q, want one of random, sequential or fixed", strategy)
+	}
+}
+
+// newDNSTLSConfig returns the TLS config of stats queries for
+// -dns_protocol=tcp-tls. If caFile is non-empty, the certificate of dnsmasq is
+// verified against its PEM-encoded CA certificates instead of the system
+// roots.
+func newDNSTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM-encoded certificates found", caFile)
+	}
+	return cfg, nil
+}
+
+// parseMetricsPaths parses the comma-separated -metrics_path. Blank entries
+// are skipped, while duplicates (which http.ServeMux cannot register) and
+// relative paths are rejected.
+func parseMetricsPaths(list string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, path := range strings.Split(list, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q does not start with /", path)
 		}
-		for _, a := range in.Answer {
-			txt, ok := a.(*dns.TXT)
-			if !ok {
+		if seen[path] {
+			return nil, fmt.Errorf("duplicate path %q", path)
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no path")
+	}
+	return paths, nil
+}
+
+// parseSubnets parses a list of CIDR subnets. Each entry may contain multiple
+// comma-separated subnets.
+func parseSubnets(values []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, value := range values {
+		for _, cidr := range strings.Split(value, ",") {
+			if cidr == "" {
 				continue
 			}
-			switch txt.Hdr.Name {
-			case "servers.bind.":
-				// TODO: parse <server> <successes> <errors>, also with multiple upstreams
-			default:
-				g, ok := floatMetrics[txt.Hdr.Name]
-				if !ok {
-					continue // ignore unexpected answer from dnsmasq
-				}
-				if got, want := len(txt.Txt), 1; got != want {
-					return fmt.Errorf("stats DNS record %q: unexpected number of replies: got %d, want %d", txt.Hdr.Name, got, want)
-				}
-				f, err := strconv.ParseFloat(txt.Txt[0], 64)
-				if err != nil {
-					return err
-				}
-				g.Set(f)
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
 			}
+			subnets = append(subnets, subnet)
 		}
-		return nil
-	})
+	}
+	return subnets, nil
+}
 
-	eg.Go(func() error {
-		f, err := os.Open(s.leasesPath)
+type server struct {
+	inFlight    int64 // accessed atomically
+	inFlightMu  sync.Mutex
+	inFlightMax int64 // guarded by inFlightMu
+
+	// gatherer gathers the metrics of the exporter itself, see collector
+	// for the metrics of dnsmasq.
+	gatherer prometheus.Gatherer
+
+	// hostname is added as hostname label to all metrics, if non-empty.
+	hostname string
+
+	// namespace replaces the dnsmasq namespace of all metric names, if
+	// non-empty (see -metric_namespace).
+	namespace string
+
+	// scrapeLeasesDir contains the leases files which can be selected per
+	// scrape, see scrape.
+	scrapeLeasesDir string
+
+	// collector collects the metrics of dnsmasq, of the default target
+	// (-dnsmasq and -leases_path) or the one given to scrape.
+	collector *collector.Collector
+}
+
+// enter records the start of a scrape in dnsmasq_exporter_scrapes_in_flight
+// and dnsmasq_exporter_scrapes_in_flight_max.
+func (s *server) enter() {
+	scrapesInFlight.Inc()
+	n := atomic.AddInt64(&s.inFlight, 1)
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	if n > s.inFlightMax {
+		s.inFlightMax = n
+		scrapesInFlightMax.Set(float64(n))
+	}
+}
+
+func (s *server) exit() {
+	atomic.AddInt64(&s.inFlight, -1)
+	scrapesInFlight.Dec()
+}
+
+// serve collects the metrics of a new scrape of t and serves them along with
+// the ones gathered by s.gatherer. Unless perLease is true, the perLeaseMetrics
+// are left out. If the collect[] URL parameter is given, only the metrics
+// named by it are served, following the node_exporter convention, e.g.:
+//
+//	/metrics?collect[]=dnsmasq_hits&collect[]=dnsmasq_leases
+func (s *server) serve(w http.ResponseWriter, r *http.Request, t collector.Target, perLease bool) {
+	s.enter()
+	defer s.exit()
+
+	var subnets []*net.IPNet // -lease_subnets
+	if values := r.URL.Query()["subnet"]; len(values) > 0 {
+		var err error
+		subnets, err = parseSubnets(values)
 		if err != nil {
-			log.Warnln("could not open leases file:", err)
-			return err
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := collector.WithTraceparent(r.Context(), r.Header.Get("traceparent"))
+	// Only a deadline aborts a pending stats query, so derive one from the
+	// scrape_timeout sent by Prometheus.
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(secs*float64(time.Second)))
+			defer cancel()
+		}
+	}
+
+	g := s.scrapeGatherer(ctx, t, subnets, perLease)
+	if names := r.URL.Query()["collect[]"]; len(names) > 0 {
+		wanted := make(map[string]bool)
+		for _, name := range names {
+			wanted[name] = true
+		}
+		g = filteredGatherer{
+			Gatherer: g,
+			keep:     func(name string) bool { return wanted[name] },
 		}
-		defer f.Close()
-		scanner := bufio.NewScanner(f)
-		var lines float64
-		for scanner.Scan() {
-			lines++
+	}
+	// Exemplars of dnsmasq_dns_query_duration_seconds are only exposed in
+	// the OpenMetrics format.
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+}
+
+// scrapeGatherer returns a gatherer which scrapes t (see
+// collector.Collector.Scrape), along with the globally registered metrics.
+func (s *server) scrapeGatherer(ctx context.Context, t collector.Target, subnets []*net.IPNet, perLease bool) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s.collector.Scrape(ctx, t, subnets))
+	var g prometheus.Gatherer = prometheus.Gatherers{reg, s.gatherer}
+	if !perLease {
+		g = withoutPerLeaseMetrics(g)
+	}
+	if s.hostname != "" {
+		g = constLabelGatherer{
+			Gatherer: g,
+			name:     "hostname",
+			value:    s.hostname,
 		}
-		if err := scanner.Err(); err != nil {
+	}
+	if s.namespace != "" && s.namespace != "dnsmasq" {
+		g = namespaceGatherer{
+			Gatherer:  g,
+			namespace: s.namespace,
+		}
+	}
+	return g
+}
+
+// once scrapes the default target and writes the metrics to w in the text
+// exposition format, see -once. It returns an error if the scrape failed,
+// i.e. dnsmasq_up is 0. With -collect_interval, once starts the background
+// collection itself and writes the metrics of its first collection.
+func (s *server) once(ctx context.Context, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.collector.Run(ctx)
+	mfs, err := s.scrapeGatherer(ctx, s.collector.DefaultTarget(), nil, true).Gather()
+	if err != nil {
+		return err
+	}
+	upName := "dnsmasq_up"
+	if s.namespace != "" && s.namespace != "dnsmasq" {
+		upName = s.namespace + "_up"
+	}
+	up := false
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
 			return err
 		}
-		leases.Set(lines)
-		return nil
-	})
+		if mf.GetName() == upName && len(mf.GetMetric()) > 0 {
+			up = mf.GetMetric()[0].GetGauge().GetValue() == 1
+		}
+	}
+	if !up {
+		return fmt.Errorf("scrape failed, see %s and the log", upName)
+	}
+	return nil
+}
+
+func (s *server) metrics(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, s.collector.DefaultTarget(), true)
+}
+
+// summary serves all metrics except for the per-lease series.
+func (s *server) summary(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, s.collector.DefaultTarget(), false)
+}
+
+// scrape serves the metrics of the dnsmasq instance given by the target URL
+// parameter, following the blackbox_exporter convention, e.g.:
+//
+//	/scrape?target=192.168.1.1:53&leases_path=router1.leases
+//
+// leases_path is relative to -scrape_leases_dir and defaults to -leases_path.
+func (s *server) scrape(w http.ResponseWriter, r *http.Request) {
+	t := collector.Target{
+		DnsmasqAddr: r.URL.Query().Get("target"),
+		LeasesPath:  s.collector.LeasesPath(),
+	}
+	if t.DnsmasqAddr == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if p := r.URL.Query().Get("leases_path"); p != "" {
+		if s.scrapeLeasesDir == "" {
+			http.Error(w, "leases_path parameter requires -scrape_leases_dir", http.StatusBadRequest)
+			return
+		}
+		// Cleaning the rooted path removes any .. elements, so that only
+		// files within -scrape_leases_dir can be read.
+		t.LeasesPath = filepath.Join(s.scrapeLeasesDir, filepath.Clean("/"+p))
+	}
+	s.serve(w, r, t, true)
+}
 
-	if err := eg.Wait(); err != nil {
+// leases serves the records of the -leases_path file(s) as a JSON array, see
+// collector.Collector.Leases.
+func (s *server) leases(w http.ResponseWriter, r *http.Request) {
+	leases, err := s.collector.Leases(r.Context())
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if leases == nil {
+		leases = []collector.Lease{} // encoded as [] rather than null
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(leases); err != nil {
+		slog.Warn("writing /leases response failed", "err", err)
+	}
+}
+
+// healthz reports that the exporter is up, without querying dnsmasq.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// ready reports whether dnsmasq answers cachesize.bind, and 503 Service
+// Unavailable otherwise.
+func (s *server) ready(w http.ResponseWriter, r *http.Request) {
+	if err := s.collector.Ready(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveMux is used instead of http.DefaultServeMux, on which importing
+// net/http/pprof unconditionally registers its handlers.
+var serveMux = http.NewServeMux()
+
+// handle registers h for path on serveMux, recording request durations in
+// dnsmasq_exporter_http_request_duration_seconds.
+func handle(path string, h http.Handler) {
+	serveMux.Handle(path, promhttp.InstrumentHandlerDuration(
+		httpRequestDuration.MustCurryWith(prometheus.Labels{"path": path}), h))
+}
+
+// registerPprof registers the net/http/pprof handlers under /debug/pprof/ on
+// mux.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// newListener listens on addr, which is either a TCP address (for network,
+// one of tcp, tcp4 or tcp6) or unix:<path>. A stale socket file (e.g. left
+// behind by a crash) is replaced. The socket file is removed when the listener
+// is closed, e.g. by http.Server.Shutdown.
+func newListener(addr, network string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen(network, addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// lookupIPAddrFunc resolves a hostname, like net.Resolver.LookupIPAddr.
+type lookupIPAddrFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// resolveListenAddr returns the addresses to listen on for the TCP address
+// addr. If its host is a hostname, these are all of its addresses of the
+// network's family, as e.g. localhost may resolve to both 127.0.0.1 and ::1,
+// of which net.Listen would only use one.
+func resolveListenAddr(addr, network string, lookup lookupIPAddrFunc) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ipAddrs, err := lookup(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, ipAddr := range ipAddrs {
+		v4 := ipAddr.IP.To4() != nil
+		if (network == "tcp4" && !v4) || (network == "tcp6" && v4) {
+			continue
+		}
+		a := net.JoinHostPort(ipAddr.String(), port)
+		if !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no %s address", host, network)
+	}
+	return addrs, nil
+}
+
+// newListeners listens on each of the comma-separated addrs (see newListener
+// and resolveListenAddr). Addresses of a hostname which cannot be listened on
+// are skipped with a warning, unless all of them fail. If an address fails,
+// the listeners opened so far are closed.
+func newListeners(addrs, network string, lookup lookupIPAddrFunc) ([]net.Listener, error) {
+	var lns []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if strings.HasPrefix(addr, "unix:") {
+			ln, err := newListener(addr, network)
+			if err != nil {
+				return fail(fmt.Errorf("%s: %v", addr, err))
+			}
+			lns = append(lns, ln)
+			continue
+		}
+		resolved, err := resolveListenAddr(addr, network, lookup)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v", addr, err))
+		}
+		// attempts contains the errors of the resolved addresses.
+		var attempts []string
+		var ok bool
+		for _, a := range resolved {
+			ln, err := newListener(a, network)
+			if err != nil {
+				attempts = append(attempts, err.Error())
+				continue
+			}
+			lns = append(lns, ln)
+			ok = true
+		}
+		if !ok {
+			return fail(fmt.Errorf("%s: tried %s: %s", addr, strings.Join(resolved, ", "), strings.Join(attempts, "; ")))
+		}
+		if len(attempts) > 0 {
+			slog.Warn("could not listen on all addresses", "addr", addr, "errors", attempts)
+		}
+	}
+	if len(lns) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	return lns, nil
+}
 
-	s.promHandler.ServeHTTP(w, r)
+// normalizeDnsmasqAddr returns the -dnsmasq address addr as host:port. A host
+// without port, including an IPv6 address with or without brackets, gets the
+// default DNS port 53.
+func normalizeDnsmasqAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", fmt.Errorf("empty address")
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host := addr[1 : len(addr)-1]
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("%q: invalid IP address in brackets", addr)
+		}
+		return net.JoinHostPort(host, "53"), nil
+	}
+	if _, err := netip.ParseAddr(addr); err == nil || !strings.Contains(addr, ":") {
+		return net.JoinHostPort(addr, "53"), nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("%q: invalid port %q", addr, port)
+	}
+	return net.JoinHostPort(host, port), nil
 }
 
 func main() {
 	flag.Parse()
-	s := &server{
-		promHandler: promhttp.Handler(),
-		dnsClient: &dns.Client{
-			SingleInflight: true,
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// The command line and environment take precedence over the config
+	// file, also when it is reloaded on SIGHUP.
+	pinned := setFlags(flag.CommandLine)
+	if *configFile != "" {
+		if err := loadConfig(*configFile, flag.CommandLine); err != nil {
+			fmt.Fprintln(os.Stderr, "-config.file:", err)
+			os.Exit(2)
+		}
+	}
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	subnets, err := parseSubnets([]string{*leaseSubnets})
+	if err != nil {
+		fatal("invalid -lease_subnets", "err", err)
+	}
+	dnsmasqHostPort, err := normalizeDnsmasqAddr(*dnsmasqAddr)
+	if err != nil {
+		fatal("invalid -dnsmasq address, want host, host:port or [IPv6]:port", "err", err)
+	}
+	switch *dnsQnameCase {
+	case "preserve", "lower", "random":
+	default:
+		fatal("-dns_qname_case: unknown case, want one of preserve, lower or random", "case", *dnsQnameCase)
+	}
+	if !model.IsValidMetricName(model.LabelValue(*metricNamespace + "_leases")) {
+		fatal("-metric_namespace: invalid namespace", "namespace", *metricNamespace)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls_cert and -tls_key must be specified together")
+	}
+	switch *dnsProtocol {
+	case "udp", "tcp", "tcp-tls":
+	default:
+		fatal("-dns_protocol: unknown protocol, want one of udp, tcp or tcp-tls", "protocol", *dnsProtocol)
+	}
+	switch *listenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		fatal("-listen_network: unknown network, want one of tcp, tcp4 or tcp6", "network", *listenNetwork)
+	}
+	if *dnsReuseConn && *dnsProtocol == "udp" {
+		fatal("-dns_reuse_conn requires -dns_protocol=tcp or tcp-tls")
+	}
+	metricsPaths, err := parseMetricsPaths(*metricsPath)
+	if err != nil {
+		fatal("invalid -metrics_path", "err", err)
+	}
+	if *queryLogClients && *queryLogPath == "" {
+		fatal("-query_log_clients requires -query_log_path")
+	}
+	queryID, err := newQueryIDFunc(*dnsIDStrategy)
+	if err != nil {
+		fatal("invalid -dns_id_strategy", "err", err)
+	}
+	if *leasePrefixLen < 0 || *leasePrefixLen > 8*net.IPv4len {
+		fatal("-lease_prefix_len: out of range", "lease_prefix_len", *leasePrefixLen, "max", 8*net.IPv4len)
+	}
+	if *leasePrefixLenV6 < 0 || *leasePrefixLenV6 > 8*net.IPv6len {
+		fatal("-lease_prefix_len_v6: out of range", "lease_prefix_len_v6", *leasePrefixLenV6, "max", 8*net.IPv6len)
+	}
+	if *udpBufferSize != 0 && (*udpBufferSize < dns.MinMsgSize || *udpBufferSize > dns.MaxMsgSize) {
+		fatal("-udp_buffer_size: out of range", "udp_buffer_size", *udpBufferSize, "min", dns.MinMsgSize, "max", dns.MaxMsgSize)
+	}
+	selectedLeaseLabels, err := parseLeaseLabels(*leaseLabelsFlag)
+	if err != nil {
+		fatal("invalid -lease_labels", "err", err)
+	}
+	opts := collector.Options{
+		Client: &dns.Client{
+			Net:     *dnsProtocol,
+			Timeout: *dnsTimeout,
 		},
-		dnsmasqAddr: *dnsmasqAddr,
-		leasesPath:  *leasesPath,
-	}
-	http.HandleFunc(*metricsPath, s.metrics)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>Dnsmasq Exporter</title></head>
-			<body>
-			<h1>Dnsmasq Exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
-			</body></html>`))
-	})
-	log.Infoln("Listening on", *listen)
-	log.Infoln("Serving metrics under", *metricsPath)
-	log.Fatal(http.ListenAndServe(*listen, nil))
+		DNSRetries:     *dnsRetries,
+		SplitQuestions: *dnsSplitQuestions,
+		SingleInflight: *singleInflight,
+		ReuseConn:      *dnsReuseConn,
+		SourcePort:     *dnsSourcePort,
+		StatsFile:      *statsFile,
+
+		StatsRecords:     parseRecords(*statsRecords),
+		ExtraStats:       parseRecords(*extraStats),
+		QueryID:          queryID,
+		QnameCase:        *dnsQnameCase,
+		RecursionDesired: *dnsRecursion,
+		UDPBufferSize:    uint16(*udpBufferSize),
+		NativeHistograms: *nativeHistograms,
+
+		MaxLeasesBytes:    *maxLeasesBytes,
+		StrictExpiry:      *strictExpiry,
+		KnownMACsFile:     *knownMACsFile,
+		ExposeUnknownMACs: *exposeUnknownMACs,
+		ReservationsFile:  *reservationsFile,
+		ConfFile:          *confFile,
+		ConfDir:           *confDir,
+		HideLeases:        !*exposeLeases,
+		MaxLeaseSeries:    *maxLeaseSeries,
+		StripDomain:       *stripDomain,
+		LeaseLabels:       selectedLeaseLabels,
+		LeaseSubnets:      subnets,
+		LeasePrefixLen:    *leasePrefixLen,
+		LeasePrefixLenV6:  *leasePrefixLenV6,
+		LeaseTime:         *leaseTime,
+		ResolvePTR:        *resolvePTR,
+		PTRTimeout:        *resolvePTRTimeout,
+
+		CacheDuration:   *cacheDuration,
+		CollectInterval: *collectInterval,
+	}
+	if *dnsSourceAddr != "" {
+		opts.SourceIP = net.ParseIP(*dnsSourceAddr)
+		if opts.SourceIP == nil {
+			fatal("-dns_source_addr: invalid IP address", "addr", *dnsSourceAddr)
+		}
+	}
+	if *ouiFile != "" {
+		opts.OUIs, err = collector.ReadOUIs(*ouiFile)
+		if err != nil {
+			fatal("could not read -oui_file", "path", *ouiFile, "err", err)
+		}
+	}
+	if *dnsProtocol == "tcp-tls" {
+		opts.Client.TLSConfig, err = newDNSTLSConfig(*dnsTLSCA, *dnsTLSInsecure)
+		if err != nil {
+			fatal("invalid -dns_tls_ca", "err", err)
+		}
+	}
+	s := &server{
+		gatherer:        prometheus.DefaultGatherer,
+		namespace:       *metricNamespace,
+		scrapeLeasesDir: *scrapeLeasesDir,
+		collector:       collector.New(dnsmasqHostPort, *leasesPath, opts),
+	}
+	if *addHostnameLabel {
+		hostname, err := os.Hostname()
+		if err != nil {
+			fatal("could not determine hostname", "err", err)
+		}
+		s.hostname = hostname
+	}
+	if *once {
+		if err := s.once(context.Background(), os.Stdout); err != nil {
+			fatal("-once: collection failed", "err", err)
+		}
+		return
+	}
+	landing := &landingPage{
+		Version:     version.Info(),
+		DnsmasqAddr: dnsmasqHostPort,
+		leasesPath:  s.collector.LeasesPath,
+	}
+	for _, path := range metricsPaths {
+		handle(path, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(s.metrics)))
+		landing.addLink(path, "Metrics")
+	}
+	if *summaryPath != "" {
+		handle(*summaryPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(s.summary)))
+		landing.addLink(*summaryPath, "Metrics summary (without per-lease series)")
+	}
+	if *scrapePath != "" {
+		handle(*scrapePath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(s.scrape)))
+		landing.addLink(*scrapePath, "Metrics of the dnsmasq instance passed as target URL parameter")
+	}
+	if *enableLeasesEndpoint {
+		handle("/leases", http.HandlerFunc(s.leases))
+		landing.addLink("/leases", "DHCP leases as JSON")
+	}
+	handle("/healthz", http.HandlerFunc(s.healthz))
+	landing.addLink("/healthz", "Liveness probe")
+	handle("/ready", http.HandlerFunc(s.ready))
+	landing.addLink("/ready", "Readiness probe (whether dnsmasq answers)")
+	if *enablePprof {
+		registerPprof(serveMux)
+		landing.addLink("/debug/pprof/", "Go runtime profiles")
+	}
+	handle("/", landing)
+	// runCtx is canceled on shutdown, stopping the background collection
+	// and tailing the query log.
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+	go s.collector.Run(runCtx)
+	if *queryLogPath != "" {
+		t, err := newLogTailer(*queryLogPath)
+		if err != nil {
+			fatal("could not open -query_log_path", "path", *queryLogPath, "err", err)
+		}
+		go tailQueryLog(runCtx, t, 1*time.Second, *queryLogClients)
+	}
+	var handler http.Handler = serveMux
+	if *logRequests {
+		handler = accessLog(handler)
+	}
+	if *enableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	ln, err := activationListener(os.Getpid(), os.Getenv, listenFDsStart)
+	if err != nil {
+		fatal("could not use the socket passed by systemd", "err", err)
+	}
+	activated := ln != nil
+	var lns []net.Listener
+	if activated {
+		// Do not pass the socket on to child processes.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		lns = []net.Listener{ln}
+	} else if lns, err = newListeners(*listen, *listenNetwork, net.DefaultResolver.LookupIPAddr); err != nil {
+		fatal("could not listen", "network", *listenNetwork, "err", err)
+	}
+	for _, ln := range lns {
+		listenInfo.WithLabelValues(ln.Addr().String()).Set(1)
+	}
+	var certs *certReloader
+	if *tlsCert != "" {
+		if certs, err = newCertReloader(*tlsCert, *tlsKey); err != nil {
+			fatal("could not load TLS certificate", "err", err)
+		}
+	}
+	// All listeners share the handler, but each needs its own server.
+	srvs := make([]*http.Server, len(lns))
+	for i := range lns {
+		srvs[i] = &http.Server{Handler: handler}
+		if certs != nil {
+			srvs[i].TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		}
+	}
+	// On SIGHUP, reload the config file and TLS certificate.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.reload(*configFile, flag.CommandLine, pinned, certs)
+		}
+	}()
+	// On SIGTERM (e.g. by systemd or Kubernetes) or SIGINT, stop accepting
+	// connections and give in-flight scrapes some time to complete.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+		sig := <-c
+		slog.Info("shutting down", "signal", sig.String())
+		stopRunning()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, srv := range srvs {
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("shutdown failed", "err", err)
+			}
+		}
+	}()
+	errc := make(chan error, len(lns))
+	for i, ln := range lns {
+		slog.Info("listening", "addr", ln.Addr().String(), "socket_activation", activated, "metrics_paths", strings.Join(metricsPaths, ","))
+		go func(srv *http.Server, ln net.Listener) {
+			var err error
+			if certs != nil {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != http.ErrServerClosed {
+				err = fmt.Errorf("%s: %v", ln.Addr(), err)
+			}
+			errc <- err
+		}(srvs[i], ln)
+	}
+	// Any server failing stops the process; otherwise, all servers are
+	// closed by the shutdown above.
+	for range lns {
+		if err := <-errc; err != http.ErrServerClosed {
+			fatal("serving HTTP failed", "err", err)
+		}
+	}
+	<-done
 }
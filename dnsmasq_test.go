@@ -1,19 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/google/dnsmasq_exporter/collector"
+	"github.com/google/dnsmasq_exporter/collector/collectortest"
 	"github.com/miekg/dns"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestDnsmasqExporter(t *testing.T) {
@@ -61,12 +80,11 @@ func TestDnsmasqExporter(t *testing.T) {
 	}
 
 	s := &server{
-		promHandler: promhttp.Handler(),
-		dnsClient: &dns.Client{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New("localhost:"+port, "testdata/dnsmasq.leases", collector.Options{
+			Client:         &dns.Client{},
 			SingleInflight: true,
-		},
-		dnsmasqAddr: "localhost:" + port,
-		leasesPath:  "testdata/dnsmasq.leases",
+		}),
 	}
 
 	t.Run("first", func(t *testing.T) {
@@ -125,7 +143,10 @@ func TestDnsmasqExporter(t *testing.T) {
 func fetchMetrics(t *testing.T, s *server) map[string]string {
 	rec := httptest.NewRecorder()
 	s.metrics(rec, httptest.NewRequest("GET", "/metrics", nil))
-	resp := rec.Result()
+	return parseMetrics(t, rec.Result())
+}
+
+func parseMetrics(t *testing.T, resp *http.Response) map[string]string {
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
 		b, _ := ioutil.ReadAll(resp.Body)
 		t.Fatalf("unexpected HTTP status: got %v (%v), want %v", resp.Status, string(b), want)
@@ -134,19 +155,1217 @@ func fetchMetrics(t *testing.T, s *server) map[string]string {
 	if err != nil {
 		t.Fatal(err)
 	}
-	metrics := make(map[string]string)
-	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
-		if strings.HasPrefix(line, "#") {
-			continue
+	return collectortest.ParseMetrics(string(body))
+}
+
+func TestSummary(t *testing.T) {
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New("", "testdata/dnsmasq.leases", collector.Options{
+			StatsFile: "testdata/dig.txt",
+		}),
+	}
+	rec := httptest.NewRecorder()
+	s.summary(rec, httptest.NewRequest("GET", "/metrics/summary", nil))
+	metrics := parseMetrics(t, rec.Result())
+	if got, want := metrics["dnsmasq_leases"], "2"; got != want {
+		t.Errorf("metric %q: got %q, want %q", "dnsmasq_leases", got, want)
+	}
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry") {
+			t.Errorf("per-lease metric %q unexpectedly present in summary", key)
+		}
+	}
+}
+
+func TestSubnetFilter(t *testing.T) {
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New("", "testdata/dnsmasq.leases", collector.Options{
+			StatsFile: "testdata/dig.txt",
+		}),
+	}
+	rec := httptest.NewRecorder()
+	s.metrics(rec, httptest.NewRequest("GET", "/metrics?subnet=192.168.1.11/32", nil))
+	metrics := parseMetrics(t, rec.Result())
+	if got, want := metrics["dnsmasq_leases"], "2"; got != want {
+		t.Errorf("metric %q: got %q, want %q", "dnsmasq_leases", got, want)
+	}
+	var expiries []string
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry{") {
+			expiries = append(expiries, key)
+		}
+	}
+	if got, want := len(expiries), 1; got != want {
+		t.Fatalf("unexpected number of dnsmasq_lease_expiry series: got %d (%v), want %d", got, expiries, want)
+	}
+	if !strings.Contains(expiries[0], `ip_addr="192.168.1.11"`) {
+		t.Errorf("unexpected dnsmasq_lease_expiry series: %s", expiries[0])
+	}
+
+	rec = httptest.NewRecorder()
+	s.metrics(rec, httptest.NewRequest("GET", "/metrics?subnet=invalid", nil))
+	if got, want := rec.Result().StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("unexpected HTTP status for invalid subnet: got %v, want %v", got, want)
+	}
+}
+
+func TestRuntimeCollectors(t *testing.T) {
+	// The default registry already has the collectors.
+	if err := registerRuntimeCollectors(prometheus.DefaultRegisterer); err != nil {
+		t.Fatalf("registerRuntimeCollectors(prometheus.DefaultRegisterer): %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	for i := 0; i < 2; i++ {
+		if err := registerRuntimeCollectors(reg); err != nil {
+			t.Fatalf("registerRuntimeCollectors: %v", err)
+		}
+	}
+
+	want := []string{"go_goroutines"}
+	if runtime.GOOS == "linux" {
+		want = append(want, "process_resident_memory_bytes")
+	}
+	for _, g := range []prometheus.Gatherer{prometheus.DefaultGatherer, reg} {
+		for _, name := range want {
+			if n, err := testutil.GatherAndCount(g, name); err != nil || n != 1 {
+				t.Errorf("metric %s: got %d series (err: %v), want 1", name, n, err)
+			}
+		}
+	}
+}
+
+func TestOnce(t *testing.T) {
+	for _, tt := range []struct {
+		leasesPath      string
+		namespace       string
+		collectInterval time.Duration
+		wantUp          string
+	}{
+		{"testdata/dnsmasq.leases", "", 0, "dnsmasq_up 1"},
+		{"testdata/dnsmasq.leases", "router", 0, "router_up 1"},
+		// The scrape does not wait for a background collection forever.
+		{"testdata/dnsmasq.leases", "", time.Second, "dnsmasq_up 1"},
+		// Reading a directory fails.
+		{"testdata", "", 0, "dnsmasq_up 0"},
+	} {
+		s := &server{
+			gatherer:  prometheus.DefaultGatherer,
+			namespace: tt.namespace,
+			collector: collector.New("", tt.leasesPath, collector.Options{
+				StatsFile:       "testdata/dig.txt",
+				CollectInterval: tt.collectInterval,
+			}),
+		}
+		var buf bytes.Buffer
+		err := s.once(context.Background(), &buf)
+		if got, want := err != nil, tt.wantUp == "dnsmasq_up 0"; got != want {
+			t.Errorf("%s: once: got err %v, want error: %v", tt.wantUp, err, want)
+		}
+		if !strings.Contains(buf.String(), "\n"+tt.wantUp+"\n") {
+			t.Errorf("%s: not found in output:\n%s", tt.wantUp, buf.String())
+		}
+		// The build info is exported regardless of the scrape result.
+		if !strings.Contains(buf.String(), "_exporter_build_info{") {
+			t.Errorf("%s: build info not found in output:\n%s", tt.wantUp, buf.String())
+		}
+	}
+}
+
+func TestCollectParam(t *testing.T) {
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New("", "testdata/dnsmasq.leases", collector.Options{
+			StatsFile: "testdata/dig.txt",
+		}),
+	}
+	rec := httptest.NewRecorder()
+	s.metrics(rec, httptest.NewRequest("GET", "/metrics?collect[]=dnsmasq_hits&collect[]=dnsmasq_leases", nil))
+	metrics := parseMetrics(t, rec.Result())
+	want := map[string]string{
+		"dnsmasq_hits":   "21306",
+		"dnsmasq_leases": "2",
+	}
+	if len(metrics) != len(want) {
+		t.Errorf("unexpected metrics: got %v, want %v", metrics, want)
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestQueryIDStrategy(t *testing.T) {
+	for _, tt := range []struct {
+		strategy string
+		want     []uint16
+	}{
+		{"sequential", []uint16{1, 2, 3}},
+		{"fixed", []uint16{0, 0, 0}},
+	} {
+		next, err := newQueryIDFunc(tt.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if got := next(); got != want {
+				t.Errorf("%s: got ID %d, want %d", tt.strategy, got, want)
+			}
 		}
-		parts := strings.Split(line, " ")
-		if len(parts) < 2 {
+	}
+	if _, err := newQueryIDFunc("bogus"); err == nil {
+		t.Errorf("newQueryIDFunc(bogus) unexpectedly succeeded")
+	}
+}
+
+func TestHostnameLabel(t *testing.T) {
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		hostname: "router",
+		collector: collector.New("", "testdata/dnsmasq.leases", collector.Options{
+			StatsFile: "testdata/dig.txt",
+		}),
+	}
+	metrics := fetchMetrics(t, s)
+	if got, want := metrics[`dnsmasq_leases{hostname="router"}`], "2"; got != want {
+		t.Errorf("dnsmasq_leases with hostname label: got %q, want %q", got, want)
+	}
+	key := `dnsmasq_lease_expiry{client_id="",computer_name="",hostname="router",ip_addr="192.168.1.11",mac_addr="66:77:88:99:aa:bb"}`
+	if _, ok := metrics[key]; !ok {
+		t.Errorf("metric %s not found", key)
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	// The stub never answers, so that only the scrape timeout aborts the
+	// stats query.
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer stop()
+
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New(addr, "testdata/dnsmasq.leases", collector.Options{
+			Client: &dns.Client{Timeout: time.Minute},
+		}),
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.1")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	s.metrics(rec, req)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("scrape took %v, want it to be aborted after the scrape timeout", elapsed)
+	}
+	metrics := parseMetrics(t, rec.Result())
+	if got, want := metrics[`dnsmasq_scrape_result{result="timeout"}`], "1"; got != want {
+		t.Errorf("dnsmasq_scrape_result{result=\"timeout\"}: got %q, want %q", got, want)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(collectortest.StatsReply(r, "1"))
+	})
+	defer stop()
+
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New(addr, "testdata/dnsmasq.leases", collector.Options{
+			Client: &dns.Client{},
+		}),
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.metrics(rec, req)
+	// The trace of the request is attached as an exemplar to the stats
+	// query duration.
+	if body := rec.Body.String(); !strings.Contains(body, `trace_id="4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Errorf("exemplar with the trace ID of the request not found:\n%s", body)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(collectortest.StatsReply(r, "5"))
+	})
+	defer stop()
+
+	s := &server{
+		gatherer:        prometheus.DefaultGatherer,
+		scrapeLeasesDir: "testdata",
+		// The default target is not queried.
+		collector: collector.New("127.0.0.1:1", "testdata/nonexistent", collector.Options{
+			Client: &dns.Client{},
+		}),
+	}
+	rec := httptest.NewRecorder()
+	s.scrape(rec, httptest.NewRequest("GET", "/scrape?target="+addr+"&leases_path=client_ids.leases", nil))
+	metrics := parseMetrics(t, rec.Result())
+	want := map[string]string{
+		"dnsmasq_up":        "1",
+		"dnsmasq_cachesize": "5",
+		"dnsmasq_leases":    "3",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+
+	// leases_path cannot escape -scrape_leases_dir: testdata/testdata/dnsmasq.leases
+	// does not exist.
+	rec = httptest.NewRecorder()
+	s.scrape(rec, httptest.NewRequest("GET", "/scrape?target="+addr+"&leases_path=../testdata/dnsmasq.leases", nil))
+	metrics = parseMetrics(t, rec.Result())
+	if got, want := metrics["dnsmasq_leases_file_present"], "0"; got != want {
+		t.Errorf("dnsmasq_leases_file_present: got %q, want %q", got, want)
+	}
+
+	for _, query := range []string{
+		"",                                     // missing target
+		"?target=" + addr + "&leases_path=foo", // without -scrape_leases_dir
+	} {
+		s.scrapeLeasesDir = ""
+		rec := httptest.NewRecorder()
+		s.scrape(rec, httptest.NewRequest("GET", "/scrape"+query, nil))
+		if got, want := rec.Result().StatusCode, http.StatusBadRequest; got != want {
+			t.Errorf("%q: unexpected HTTP status: got %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	addr, stop := collectortest.StartStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(collectortest.StatsReply(r, "150"))
+	})
+	defer stop()
+	// Nothing listens on the address of the closed listener.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := pc.LocalAddr().String()
+	pc.Close()
+
+	for _, tt := range []struct {
+		addr string
+		want int
+	}{
+		{addr, http.StatusOK},
+		{unreachable, http.StatusServiceUnavailable},
+	} {
+		s := &server{
+			collector: collector.New(tt.addr, "", collector.Options{
+				Client: &dns.Client{Timeout: 100 * time.Millisecond},
+			}),
+		}
+		rec := httptest.NewRecorder()
+		s.ready(rec, httptest.NewRequest("GET", "/ready", nil))
+		if got := rec.Result().StatusCode; got != tt.want {
+			t.Errorf("%s: unexpected HTTP status: got %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestMetricNamespace(t *testing.T) {
+	s := &server{
+		gatherer:  prometheus.DefaultGatherer,
+		namespace: "dnsmasqfork",
+		collector: collector.New("", "testdata/dnsmasq.leases", collector.Options{
+			StatsFile: "testdata/dig.txt",
+		}),
+	}
+	rec := httptest.NewRecorder()
+	s.metrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "dnsmasq_") {
+			t.Errorf("metric without namespace: %s", line)
+		}
+	}
+	for _, want := range []string{"dnsmasqfork_leases 2", "dnsmasqfork_cachesize 150"} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("%q not found", want)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("discarded")
+	logger.Warn("kept", "path", "/var/lib/misc/dnsmasq.leases")
+	if got, want := strings.TrimSpace(buf.String()), `"msg":"kept","path":"/var/lib/misc/dnsmasq.leases"}`; !strings.HasSuffix(got, want) || strings.Contains(got, "discarded") {
+		t.Errorf("unexpected log output: got %q, want a single line ending in %q", got, want)
+	}
+
+	for _, tt := range []struct{ level, format string }{
+		{"verbose", "logfmt"},
+		{"info", "xml"},
+	} {
+		if _, err := newLogger(&buf, tt.level, tt.format); err == nil {
+			t.Errorf("newLogger(%q, %q): unexpectedly succeeded", tt.level, tt.format)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "exporter.sock")
+
+	// A socket file left behind by a previous process is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := newListener("unix:"+path, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "ok"; got != want {
+		t.Errorf("GET /healthz: got %q, want %q", got, want)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file %s not removed on shutdown: %v", path, err)
+	}
+}
+
+func TestNormalizeDnsmasqAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr string
+		want string
+	}{
+		{"localhost:53", "localhost:53"},
+		{"localhost", "localhost:53"},
+		{"192.0.2.1", "192.0.2.1:53"},
+		{"192.0.2.1:5353", "192.0.2.1:5353"},
+		{"[::1]", "[::1]:53"},
+		{"[::1]:5353", "[::1]:5353"},
+		{"::1", "[::1]:53"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:53"},
+	} {
+		got, err := normalizeDnsmasqAddr(tt.addr)
+		if err != nil {
+			t.Errorf("normalizeDnsmasqAddr(%q): %v", tt.addr, err)
 			continue
 		}
-		if !strings.HasPrefix(parts[0], "dnsmasq_") {
+		if got != tt.want {
+			t.Errorf("normalizeDnsmasqAddr(%q): got %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	for _, addr := range []string{"", "[localhost]", "[::1", "::1]:53", "localhost:", "localhost:dns", "localhost:0", "localhost:65536", "a:b:c"} {
+		if got, err := normalizeDnsmasqAddr(addr); err == nil {
+			t.Errorf("normalizeDnsmasqAddr(%q): got %q, want error", addr, got)
+		}
+	}
+}
+
+func TestNewListeners(t *testing.T) {
+	lns, err := newListeners("127.0.0.1:0, 127.0.0.1:0", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ln := range lns {
+		defer ln.Close()
+	}
+	if got, want := len(lns), 2; got != want {
+		t.Fatalf("unexpected number of listeners: got %d, want %d", got, want)
+	}
+
+	// Binding an address in use fails, closing the listeners opened so far.
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "exporter.sock")
+	busy := lns[0].Addr().String()
+	_, err = newListeners("unix:"+path+","+busy, "tcp", nil)
+	if err == nil || !strings.Contains(err.Error(), busy) {
+		t.Errorf("newListeners: got %v, want error mentioning %s", err, busy)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("listener on %s not closed: %v", path, err)
+	}
+
+	if _, err := newListeners(" , ", "tcp", nil); err == nil {
+		t.Errorf("newListeners without address unexpectedly succeeded")
+	}
+}
+
+func TestNewListenersHostname(t *testing.T) {
+	lookup := func(ips ...string) lookupIPAddrFunc {
+		return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			if host != "exporter.example" {
+				return nil, fmt.Errorf("unknown host %q", host)
+			}
+			var addrs []net.IPAddr
+			for _, ip := range ips {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+			return addrs, nil
+		}
+	}
+
+	for _, tt := range []struct {
+		network string
+		ips     []string
+		want    []string
+	}{
+		{"tcp", []string{"127.0.0.1", "::1", "127.0.0.1"}, []string{"127.0.0.1:9153", "[::1]:9153"}},
+		{"tcp4", []string{"127.0.0.1", "::1"}, []string{"127.0.0.1:9153"}},
+		{"tcp6", []string{"127.0.0.1", "::1"}, []string{"[::1]:9153"}},
+	} {
+		got, err := resolveListenAddr("exporter.example:9153", tt.network, lookup(tt.ips...))
+		if err != nil {
+			t.Errorf("resolveListenAddr(%s, %q): %v", tt.network, tt.ips, err)
 			continue
 		}
-		metrics[parts[0]] = parts[1]
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolveListenAddr(%s, %q): got %q, want %q", tt.network, tt.ips, got, tt.want)
+		}
+	}
+	// IP addresses (and an empty host) are not resolved.
+	for _, addr := range []string{"127.0.0.1:9153", "[::1]:9153", ":9153"} {
+		got, err := resolveListenAddr(addr, "tcp", nil)
+		if err != nil || !reflect.DeepEqual(got, []string{addr}) {
+			t.Errorf("resolveListenAddr(%s): got %q, %v, want %q", addr, got, err, addr)
+		}
+	}
+	if _, err := resolveListenAddr("exporter.example:9153", "tcp6", lookup("127.0.0.1")); err == nil {
+		t.Errorf("resolveListenAddr without IPv6 address unexpectedly succeeded")
+	}
+
+	// Listening succeeds if any of the addresses can be listened on, and
+	// fails listing the attempts otherwise.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, port, _ := net.SplitHostPort(busy.Addr().String())
+	lns, err := newListeners("exporter.example:"+port, "tcp", lookup("127.0.0.1", "127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ln := range lns {
+		ln.Close()
+	}
+	if got, want := len(lns), 1; got != want {
+		t.Errorf("unexpected number of listeners: got %d, want %d", got, want)
+	}
+	_, err = newListeners("exporter.example:"+port, "tcp", lookup("127.0.0.1"))
+	if want := "tried 127.0.0.1:" + port + ": "; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("newListeners: got %v, want error containing %q", err, want)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`dnsmasq: localhost:5353
+listen: localhost:9153
+dns_timeout: 2s
+expose_leases: false
+stats_records: [cachesize.bind, hits.bind]
+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("dnsmasq_exporter", flag.ContinueOnError)
+	dnsmasq := fs.String("dnsmasq", "localhost:53", "")
+	listen := fs.String("listen", "", "")
+	timeout := fs.Duration("dns_timeout", 5*time.Second, "")
+	expose := fs.Bool("expose_leases", true, "")
+	records := fs.String("stats_records", "", "")
+	if err := fs.Parse([]string{"-listen=localhost:9999"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(f.Name(), fs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *dnsmasq, "localhost:5353"; got != want {
+		t.Errorf("dnsmasq: got %q, want %q", got, want)
+	}
+	// The command line takes precedence over the file.
+	if got, want := *listen, "localhost:9999"; got != want {
+		t.Errorf("listen: got %q, want %q", got, want)
+	}
+	if got, want := *timeout, 2*time.Second; got != want {
+		t.Errorf("dns_timeout: got %v, want %v", got, want)
+	}
+	if *expose {
+		t.Errorf("expose_leases: got true, want false")
+	}
+	if got, want := *records, "cachesize.bind,hits.bind"; got != want {
+		t.Errorf("stats_records: got %q, want %q", got, want)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("dnsmasq_addr: localhost:53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(f.Name(), fs); err == nil {
+		t.Errorf("loadConfig: unexpectedly succeeded for unknown option")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("leases_path: a.leases\nlisten: localhost:9153\ndns_timeout: 2s\n")
+
+	fs := flag.NewFlagSet("dnsmasq_exporter", flag.ContinueOnError)
+	leases := fs.String("leases_path", "default.leases", "")
+	listen := fs.String("listen", "localhost:9153", "")
+	timeout := fs.Duration("dns_timeout", 5*time.Second, "")
+	dnsmasq := fs.String("dnsmasq", "localhost:53", "")
+	if err := fs.Parse([]string{"-dnsmasq=localhost:5353"}); err != nil {
+		t.Fatal(err)
+	}
+	pinned := setFlags(fs)
+	if err := loadConfig(path, fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// dns_timeout is no longer in the file, so it is reset to its default.
+	// The command line still takes precedence.
+	write("leases_path: b.leases\nlisten: localhost:9153\ndnsmasq: localhost:53\n")
+	changed, err := reloadConfig(path, fs, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dns_timeout", "leases_path"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("reloadConfig: got changed %q, want %q", changed, want)
+	}
+	if got, want := *leases, "b.leases"; got != want {
+		t.Errorf("leases_path: got %q, want %q", got, want)
+	}
+	if got, want := *timeout, 5*time.Second; got != want {
+		t.Errorf("dns_timeout: got %v, want %v", got, want)
+	}
+	if got, want := *dnsmasq, "localhost:5353"; got != want {
+		t.Errorf("dnsmasq: got %q, want %q", got, want)
+	}
+
+	// An invalid value leaves all flags unchanged.
+	write("leases_path: c.leases\nlisten: localhost:9999\ndns_timeout: never\n")
+	if _, err := reloadConfig(path, fs, pinned); err == nil {
+		t.Errorf("reloadConfig: unexpectedly succeeded for invalid dns_timeout")
+	}
+	if *leases != "b.leases" || *listen != "localhost:9153" || *timeout != 5*time.Second {
+		t.Errorf("reloadConfig: flags changed despite error: leases_path %q, listen %q, dns_timeout %v", *leases, *listen, *timeout)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert := func() tls.Certificate {
+		cert, certPEM := selfSignedCert(t)
+		der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte("leases_path: testdata/lease_states.leases\nlisten: localhost:9999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("dnsmasq_exporter", flag.ContinueOnError)
+	fs.String("leases_path", "testdata/dnsmasq.leases", "")
+	fs.String("listen", "localhost:9153", "")
+	fs.String("tls_cert", certFile, "")
+	fs.String("tls_key", keyFile, "")
+	writeCert()
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		gatherer: prometheus.DefaultGatherer,
+		collector: collector.New("", "testdata/dnsmasq.leases", collector.Options{
+			StatsFile: "testdata/dig.txt",
+		}),
+	}
+
+	rotated := writeCert()
+	s.reload(path, fs, nil, certs)
+	if got, want := fetchMetrics(t, s)["dnsmasq_leases"], "3"; got != want {
+		t.Errorf("dnsmasq_leases after reload: got %q, want %q", got, want)
+	}
+	got, err := certs.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Certificate[0], rotated.Certificate[0]) {
+		t.Errorf("getCertificate: got the previous certificate after reload")
+	}
+
+	// A broken certificate keeps the previous one.
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reload(path, fs, nil, certs)
+	if got, err = certs.getCertificate(nil); err != nil || !bytes.Equal(got.Certificate[0], rotated.Certificate[0]) {
+		t.Errorf("getCertificate: got %v, %v, want the previous certificate", got, err)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Importing net/http/pprof registers its handlers on
+	// http.DefaultServeMux only, so they are not served without
+	// -enable_pprof.
+	if _, pattern := serveMux.Handler(httptest.NewRequest("GET", "/debug/pprof/", nil)); pattern != "" {
+		t.Errorf("serveMux unexpectedly handles /debug/pprof/ (pattern %q)", pattern)
+	}
+	registerPprof(mux)
+	if got, want := get("/debug/pprof/goroutine?debug=1"), http.StatusOK; got != want {
+		t.Errorf("after registerPprof: got HTTP status %d, want %d", got, want)
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("dnsmasq_exporter", flag.ContinueOnError)
+	dnsmasq := fs.String("dnsmasq", "localhost:53", "")
+	listen := fs.String("listen", "localhost:9153", "")
+	level := fs.String("log.level", "info", "")
+	leases := fs.String("leases_path", "/var/lib/misc/dnsmasq.leases", "")
+	if err := fs.Parse([]string{"-listen=localhost:9999"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"DNSMASQ_EXPORTER_DNSMASQ":   "localhost:5353",
+		"DNSMASQ_EXPORTER_LISTEN":    "localhost:1234",
+		"DNSMASQ_EXPORTER_LOG_LEVEL": "debug",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	if err := setFlagsFromEnv(fs, lookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want string
+	}{
+		{"dnsmasq", *dnsmasq, "localhost:5353"},
+		// The command line takes precedence over the environment.
+		{"listen", *listen, "localhost:9999"},
+		{"log.level", *level, "debug"},
+		{"leases_path", *leases, "/var/lib/misc/dnsmasq.leases"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+
+	fs.Bool("h2c", false, "")
+	env["DNSMASQ_EXPORTER_H2C"] = "maybe"
+	if err := setFlagsFromEnv(fs, lookupEnv); err == nil {
+		t.Errorf("setFlagsFromEnv: unexpectedly succeeded for invalid boolean")
+	}
+}
+
+func TestLeasesEndpoint(t *testing.T) {
+	s := &server{
+		collector: collector.New("", "testdata/dual_stack.leases", collector.Options{}),
+	}
+	rec := httptest.NewRecorder()
+	s.leases(rec, httptest.NewRequest("GET", "/leases", nil))
+	resp := rec.Result()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %v, want %v", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("Content-Type: got %q, want %q", got, want)
+	}
+	var leases []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&leases); err != nil {
+		t.Fatal(err)
+	}
+	var v4, v6 int
+	for _, l := range leases {
+		if l["v6"] == true {
+			v6++
+		} else {
+			v4++
+		}
+	}
+	if v4 == 0 || v6 == 0 {
+		t.Fatalf("got %d DHCPv4 and %d DHCPv6 leases, want both: %v", v4, v6, leases)
+	}
+	want := map[string]interface{}{
+		"expiry":    4102444800.0,
+		"mac":       "00:11:22:33:44:55",
+		"ip":        "192.168.1.10",
+		"hostname":  "laptop",
+		"client_id": "01:00:11:22:33:44:55",
+	}
+	if !reflect.DeepEqual(leases[0], want) {
+		t.Errorf("first lease: got %v, want %v", leases[0], want)
+	}
+}
+
+func TestActivationListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// activationListener closes the passed file descriptor, so pass a
+	// duplicate.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID": "1234",
+		"LISTEN_FDS": "1",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	// The sockets were passed to another process.
+	if got, err := activationListener(4321, getenv, uintptr(fd)); err != nil || got != nil {
+		t.Fatalf("activationListener(other pid) = %v, %v, want nil, nil", got, err)
+	}
+
+	activated, err := activationListener(1234, getenv, uintptr(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activated == nil {
+		t.Fatal("activationListener: got nil listener")
+	}
+	defer activated.Close()
+	if got, want := activated.Addr().String(), ln.Addr().String(); got != want {
+		t.Errorf("activated listener address: got %q, want %q", got, want)
+	}
+}
+
+func TestQueryType(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want string // or "" if not a query
+	}{
+		{"Oct 14 05:00:00 dnsmasq[1234]: query[A] example.com from 192.168.1.10", "A"},
+		{"Oct 14 05:00:00 dnsmasq[1234]: 12 192.168.1.10/53012 query[AAAA] example.com from 192.168.1.10", "AAAA"},
+		{"Oct 14 05:00:00 dnsmasq[1234]: query[type=65] example.com from 192.168.1.10", "type=65"},
+		{"Oct 14 05:00:00 dnsmasq[1234]: forwarded example.com to 1.1.1.1", ""},
+		{"Oct 14 05:00:00 named[99]: client query[A] example.com", ""},
+	} {
+		got, ok := queryType(tt.line)
+		if !ok {
+			got = ""
+		}
+		if got != tt.want {
+			t.Errorf("queryType(%q): got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestQueryClient(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want string // or "" if not a query
+	}{
+		{"Oct 14 05:00:00 dnsmasq[1234]: query[A] example.com from 192.168.1.10", "192.168.1.10"},
+		{"Oct 14 05:00:00 dnsmasq[1234]: 12 192.168.1.10/53012 query[AAAA] example.com from 192.168.1.10", "192.168.1.10"},
+		{"Oct 14 05:00:00 dnsmasq[1234]: query[A] example.com from 2001:db8::10", "2001:db8::10"},
+		{"Oct 14 05:00:00 dnsmasq[1234]: query[A] example.com from", ""},
+		{"Oct 14 05:00:00 dnsmasq[1234]: forwarded example.com from 192.168.1.10", ""},
+	} {
+		got, ok := queryClient(tt.line)
+		if !ok {
+			got = ""
+		}
+		if got != tt.want {
+			t.Errorf("queryClient(%q): got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLogTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsmasq.log")
+	write := func(flag int, s string) {
+		t.Helper()
+		f, err := os.OpenFile(path, flag|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := func(tail *logTailer, want ...string) {
+		t.Helper()
+		got, err := tail.lines()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("lines: got %q, want %q", got, want)
+		}
+	}
+
+	write(os.O_TRUNC, "old\n")
+	tail, err := newLogTailer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.close()
+	lines(tail) // existing contents are skipped
+	write(os.O_APPEND, "one\ntw")
+	lines(tail, "one")
+	write(os.O_APPEND, "o\n")
+	lines(tail, "two")
+
+	// Rotation: the rest of the old file is read, then the new file.
+	write(os.O_APPEND, "three\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(os.O_TRUNC, "four\n")
+	lines(tail, "three")
+	lines(tail, "four")
+
+	// Truncation: the file is read from the beginning.
+	write(os.O_TRUNC, "5\n")
+	lines(tail, "5")
+}
+
+func TestTailQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsmasq.log")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := newLogTailer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("Oct 14 05:00:00 dnsmasq[1234]: query[NAPTR] example.com from 192.0.2.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(queriesByType.WithLabelValues("NAPTR"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tailQueryLog(ctx, tail, 10*time.Millisecond, true)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(clientQueries.WithLabelValues("192.0.2.53")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("query not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tailQueryLog not stopped")
+	}
+	if got, want := testutil.ToFloat64(queriesByType.WithLabelValues("NAPTR"))-before, 1.0; got != want {
+		t.Errorf("dnsmasq_queries_by_type_total{type=NAPTR}: got %v more, want %v", got, want)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	p := &landingPage{
+		Version:     "(version=1.0)",
+		DnsmasqAddr: "localhost:53",
+		LeasesPath:  "/var/lib/misc/<dnsmasq>.leases",
+	}
+	p.addLink("/metrics", "Metrics")
+	p.addLink("/leases", "DHCP leases as JSON")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"(version=1.0)",
+		"localhost:53",
+		"/var/lib/misc/&lt;dnsmasq&gt;.leases",
+		`<a href="/metrics">/metrics</a>: Metrics`,
+		`<a href="/leases">/leases</a>: DHCP leases as JSON`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("landing page does not contain %q:\n%s", want, body)
+		}
+	}
+	if got, want := rec.Header().Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Errorf("Content-Type: got %q, want %q", got, want)
+	}
+
+	// After reloading, the current leases path is shown.
+	s := &server{
+		collector: collector.New("", "/var/lib/misc/dnsmasq.leases", collector.Options{}),
+	}
+	p.leasesPath = s.collector.LeasesPath
+	s.collector.SetLeasesPath("/run/dnsmasq.leases")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "leases: /run/dnsmasq.leases") {
+		t.Errorf("landing page does not show the reloaded leases path:\n%s", body)
+	}
+}
+
+func TestParseLeaseLabels(t *testing.T) {
+	got, err := parseLeaseLabels("computer_name, ip_addr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ip_addr", "computer_name"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLeaseLabels: got %q, want %q", got, want)
+	}
+	for _, value := range []string{"", ",", "ip_addr,hostname"} {
+		if _, err := parseLeaseLabels(value); err == nil {
+			t.Errorf("parseLeaseLabels(%q): unexpectedly succeeded", value)
+		}
+	}
+}
+
+func TestParseMetricsPaths(t *testing.T) {
+	got, err := parseMetricsPaths(" /metrics, ,/dnsmasq/metrics,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/metrics", "/dnsmasq/metrics"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMetricsPaths: got %q, want %q", got, want)
+	}
+	for _, value := range []string{"", " , ", "/metrics,/metrics", "/metrics, /metrics", "metrics"} {
+		if _, err := parseMetricsPaths(value); err == nil {
+			t.Errorf("parseMetricsPaths(%q): unexpectedly succeeded", value)
+		}
+	}
+}
+
+// selfSignedCert returns a self-signed certificate for 127.0.0.1 and its
+// PEM encoding.
+func selfSignedCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	cert, certPEM := selfSignedCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener: ln,
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(collectortest.StatsReply(r, "42"))
+		}),
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	dir, err := ioutil.TempDir("", "dnsmasq_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		caFile   string
+		insecure bool
+		up       string
+	}{
+		{caFile, false, "1"},
+		{"", true, "1"},
+		{"", false, "0"}, // signed by an unknown authority
+	} {
+		cfg, err := newDNSTLSConfig(tt.caFile, tt.insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &server{
+			gatherer: prometheus.DefaultGatherer,
+			collector: collector.New(ln.Addr().String(), "testdata/dnsmasq.leases", collector.Options{
+				Client: &dns.Client{
+					Net:       "tcp-tls",
+					TLSConfig: cfg,
+					Timeout:   5 * time.Second,
+				},
+			}),
+		}
+		metrics := fetchMetrics(t, s)
+		if got, want := metrics["dnsmasq_up"], tt.up; got != want {
+			t.Errorf("ca %q, insecure %v: dnsmasq_up: got %q, want %q", tt.caFile, tt.insecure, got, want)
+		}
+		if tt.up == "1" {
+			if got, want := metrics["dnsmasq_cachesize"], "42"; got != want {
+				t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+			}
+		}
+	}
+
+	if _, err := newDNSTLSConfig("testdata/dig.txt", false); err == nil {
+		t.Errorf("newDNSTLSConfig with a file without certificates unexpectedly succeeded")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	for _, tt := range []struct {
+		path   string
+		status float64
+	}{
+		{"/metrics", http.StatusOK},
+		{"/missing", http.StatusNotFound},
+	} {
+		buf.Reset()
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: %v (log output %q)", tt.path, err, buf.String())
+		}
+		for key, want := range map[string]interface{}{
+			"level":       "INFO",
+			"msg":         "request",
+			"method":      "GET",
+			"path":        tt.path,
+			"remote_addr": "192.0.2.1:1234",
+			"status":      tt.status,
+		} {
+			if got := entry[key]; got != want {
+				t.Errorf("%s: log entry %q: got %v, want %v", tt.path, key, got, want)
+			}
+		}
+		if _, ok := entry["duration"]; !ok {
+			t.Errorf("%s: log entry without duration: %v", tt.path, entry)
+		}
 	}
-	return metrics
 }
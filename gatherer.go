@@ -0,0 +1,88 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// filteredGatherer is a prometheus.Gatherer which only returns the metric
+// families for which keep returns true.
+type filteredGatherer struct {
+	prometheus.Gatherer
+	keep func(name string) bool
+}
+
+func (g filteredGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	var filtered []*dto.MetricFamily
+	for _, mf := range mfs {
+		if g.keep(mf.GetName()) {
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered, err
+}
+
+// constLabelGatherer is a prometheus.Gatherer which adds a constant label to
+// all metrics which do not already have a label of that name.
+type constLabelGatherer struct {
+	prometheus.Gatherer
+	name, value string
+}
+
+func (g constLabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+	metrics:
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if lp.GetName() == g.name {
+					continue metrics
+				}
+			}
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(g.name),
+				Value: proto.String(g.value),
+			})
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+	return mfs, err
+}
+
+// namespaceGatherer is a prometheus.Gatherer which replaces the dnsmasq
+// namespace of all metric names by namespace.
+type namespaceGatherer struct {
+	prometheus.Gatherer
+	namespace string
+}
+
+func (g namespaceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if name := mf.GetName(); strings.HasPrefix(name, "dnsmasq_") {
+			mf.Name = proto.String(g.namespace + strings.TrimPrefix(name, "dnsmasq"))
+		}
+	}
+	return mfs, err
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>Dnsmasq Exporter</title></head>
+<body>
+<h1>Dnsmasq Exporter</h1>
+<p>Version: {{.Version}}</p>
+<p>dnsmasq: {{.DnsmasqAddr}}, leases: {{.LeasesPath}}</p>
+<ul>
+{{- range .Links}}
+<li><a href="{{.Path}}">{{.Path}}</a>: {{.Description}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+type landingLink struct {
+	Path        string
+	Description string
+}
+
+// landingPage is the page served under /, listing the enabled endpoints.
+type landingPage struct {
+	Version     string
+	DnsmasqAddr string
+	LeasesPath  string
+	Links       []landingLink
+
+	// leasesPath returns the current LeasesPath, which changes when
+	// reloading the config file, if non-nil.
+	leasesPath func() string
+}
+
+func (p *landingPage) addLink(path, description string) {
+	p.Links = append(p.Links, landingLink{Path: path, Description: description})
+}
+
+func (p *landingPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page := *p
+	if p.leasesPath != nil {
+		page.LeasesPath = p.leasesPath()
+	}
+	if err := landingTemplate.Execute(w, &page); err != nil {
+		slog.Warn("could not render landing page", "err", err)
+	}
+}
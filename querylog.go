@@ -0,0 +1,209 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queriesByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dnsmasq_queries_by_type_total",
+	Help: "Number of DNS queries logged by dnsmasq (log-queries) in -query_log_path, by query type",
+}, []string{"type"})
+
+var clientQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dnsmasq_client_queries_total",
+	Help: "Number of DNS queries logged by dnsmasq (log-queries) in -query_log_path, by client address, see -query_log_clients",
+}, []string{"client"})
+
+// queryType returns the query type of a log-queries line, e.g. A for
+//
+//	Oct 14 05:00:00 dnsmasq[1234]: query[A] example.com from 192.168.1.10
+//
+// or false if line does not log a query.
+func queryType(line string) (string, bool) {
+	i := strings.Index(line, "dnsmasq[")
+	if i == -1 {
+		return "", false
+	}
+	line = line[i:]
+	// With log-queries=extra, the query is preceded by a serial number and
+	// the requestor's address.
+	i = strings.Index(line, " query[")
+	if i == -1 {
+		return "", false
+	}
+	qtype, _, ok := strings.Cut(line[i+len(" query["):], "]")
+	if !ok || qtype == "" {
+		return "", false
+	}
+	return qtype, true
+}
+
+// queryClient returns the address of the client of a log-queries line, e.g.
+// 192.168.1.10 for the query above, or false if line does not log a query.
+func queryClient(line string) (string, bool) {
+	if _, ok := queryType(line); !ok {
+		return "", false
+	}
+	i := strings.LastIndex(line, " from ")
+	if i == -1 {
+		return "", false
+	}
+	client := strings.TrimSpace(line[i+len(" from "):])
+	if net.ParseIP(client) == nil {
+		return "", false
+	}
+	return client, true
+}
+
+// logTailer reads the lines appended to a log file. When the file is rotated
+// (replaced by a file with a different inode) or truncated, the new contents
+// are read from the beginning.
+type logTailer struct {
+	path    string
+	f       *os.File
+	fi      os.FileInfo
+	r       *bufio.Reader
+	offset  int64
+	partial string // incomplete last line
+}
+
+// newLogTailer opens the log file at path, skipping its current contents. A
+// file which does not exist yet is read from the beginning once it does.
+func newLogTailer(path string) (*logTailer, error) {
+	t := &logTailer{path: path}
+	if err := t.open(); err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	offset, err := t.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.f.Close()
+		return nil, err
+	}
+	t.offset = offset
+	return t, nil
+}
+
+func (t *logTailer) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.fi, t.r, t.offset, t.partial = f, fi, bufio.NewReader(f), 0, ""
+	return nil
+}
+
+// lines returns the complete lines appended since the last call.
+func (t *logTailer) lines() ([]string, error) {
+	if t.f == nil {
+		if err := t.open(); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	if fi, err := os.Stat(t.path); err == nil && os.SameFile(fi, t.fi) && fi.Size() < t.offset {
+		slog.Debug("query log truncated", "path", t.path)
+		if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		t.r.Reset(t.f)
+		t.offset, t.partial = 0, ""
+	}
+	lines, err := t.read()
+	if err != nil {
+		return lines, err
+	}
+	// The remaining lines of a rotated file have been read above, so
+	// switch to the new file for the next call.
+	if fi, err := os.Stat(t.path); err == nil && !os.SameFile(fi, t.fi) {
+		slog.Debug("query log rotated", "path", t.path)
+		t.f.Close()
+		t.f = nil
+	}
+	return lines, nil
+}
+
+func (t *logTailer) read() ([]string, error) {
+	var lines []string
+	for {
+		line, err := t.r.ReadString('\n')
+		t.offset += int64(len(line))
+		if err == io.EOF {
+			t.partial += line
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, strings.TrimSuffix(t.partial+line, "\n"))
+		t.partial = ""
+	}
+}
+
+func (t *logTailer) close() {
+	if t.f != nil {
+		t.f.Close()
+	}
+}
+
+// tailQueryLog counts the queries read by t in queriesByType (and in
+// clientQueries if clients is true) every interval, until ctx is done.
+func tailQueryLog(ctx context.Context, t *logTailer, interval time.Duration, clients bool) {
+	defer t.close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		lines, err := t.lines()
+		if err != nil {
+			slog.Warn("could not read query log", "path", t.path, "err", err)
+		}
+		for _, line := range lines {
+			if qtype, ok := queryType(line); ok {
+				queriesByType.WithLabelValues(qtype).Inc()
+			}
+			if !clients {
+				continue
+			}
+			if client, ok := queryClient(line); ok {
+				clientQueries.WithLabelValues(client).Inc()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"sync"
+)
+
+// certReloader serves the TLS certificate of -tls_cert and -tls_key, which is
+// re-read on SIGHUP so that certificates can be rotated without a restart.
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate // guarded by mu
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{}
+	if err := r.load(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load replaces the certificate. On error, the previous certificate is kept.
+func (r *certReloader) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reloadable are the flags which take effect when changed by reload.
+var reloadable = map[string]bool{
+	"leases_path": true,
+	"tls_cert":    true,
+	"tls_key":     true,
+}
+
+// reload re-reads the config file at path (if any) into fs, see
+// reloadConfig, and applies the changed flags to s. The TLS certificate is
+// re-read from -tls_cert and -tls_key if certs is not nil, even if the flags
+// did not change. Other flags require a restart, which is logged.
+func (s *server) reload(path string, fs *flag.FlagSet, pinned map[string]bool, certs *certReloader) {
+	if path != "" {
+		changed, err := reloadConfig(path, fs, pinned)
+		if err != nil {
+			slog.Warn("could not reload config file, keeping the previous configuration", "path", path, "err", err)
+			return
+		}
+		for _, name := range changed {
+			if !reloadable[name] || (certs == nil && (name == "tls_cert" || name == "tls_key")) {
+				slog.Warn("option changed in config file, restart to apply it", "option", name)
+			}
+		}
+		slog.Info("reloaded config file", "path", path, "changed", changed)
+	}
+	s.collector.SetLeasesPath(fs.Lookup("leases_path").Value.String())
+	if certs == nil {
+		return
+	}
+	certFile, keyFile := fs.Lookup("tls_cert").Value.String(), fs.Lookup("tls_key").Value.String()
+	if certFile == "" || keyFile == "" {
+		slog.Warn("TLS cannot be disabled without a restart, keeping the previous certificate")
+		return
+	}
+	if err := certs.load(certFile, keyFile); err != nil {
+		slog.Warn("could not reload TLS certificate, keeping the previous one", "err", err)
+		return
+	}
+	slog.Info("reloaded TLS certificate", "cert", certFile)
+}